@@ -13,31 +13,97 @@
 package websocket
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
-// Dial .
+// defaultHandshakeTimeout bounds Dial.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// Dial connects to WebSocket server with options, the dialing is bounded by
+// 10 seconds. Use Dialer.DialContext to control it by context.
 func Dial(URL string, opts ...DialOption) (*Conn, error) {
+	d := Dialer{HandshakeTimeout: defaultHandshakeTimeout}
+	conn, _, err := d.DialContext(context.Background(), URL, nil, opts...)
+	return conn, err
+}
+
+// Dialer contains options for connecting to WebSocket server, the zero value
+// is ready to use. Options of DialContext override the fields of Dialer.
+type Dialer struct {
+	// HandshakeTimeout bounds the whole dialing, including DNS, connecting,
+	// TLS handshake and upgrade exchange. 0 means no timeout except ctx.
+	HandshakeTimeout time.Duration
+
+	// NetDialContext dials the TCP connection, net.Dialer.DialContext is
+	// used if it's nil.
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Proxy returns the proxy URL for the upgrade request, it connects to
+	// server directly if Proxy is nil or it returns nil. http.ProxyFromEnvironment
+	// could be used to respect HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+	// Schemes http (CONNECT), socks5 and socks5h are supported, the userinfo
+	// of proxy URL is used for authentication. NetDialContext dials the proxy.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// TLSClientConfig is used by wss, the ServerName is the host of URL if
+	// it's not set.
+	TLSClientConfig *tls.Config
+
+	// Jar provides cookies to the upgrade request, and stores cookies from
+	// the response. Cookies are not sent if it's nil.
+	Jar http.CookieJar
+
+	// ReadBufferSize, WriteBufferSize and WriteBufferPool configure the
+	// buffers of Conn, see Upgrader.ReadBufferSize.
+	ReadBufferSize  int
+	WriteBufferSize int
+	WriteBufferPool BufferPool
+}
+
+// DialContext connects to WebSocket server, ctx governs DNS, connecting, TLS
+// handshake and upgrade exchange, and it does not affect the Conn after
+// DialContext returns. header is sent along with the upgrade request.
+//
+// The response of upgrade request is returned once it's received, even if
+// the handshake fails, and HandshakeError is returned in that case. Body of
+// the response is at most 1KB and it has been read into HandshakeError.Body.
+func (d *Dialer) DialContext(ctx context.Context, URL string, header http.Header, opts ...DialOption) (*Conn, *http.Response, error) {
 	do, err := parseURL(URL)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	do.header = header
+	do.jar = d.Jar
+	do.netDialContext = d.NetDialContext
+	do.proxy = d.Proxy
+	do.tlsConfig = d.TLSClientConfig
+	do.readBufferSize = d.ReadBufferSize
+	do.writeBufferSize = d.WriteBufferSize
+	do.writeBufferPool = d.WriteBufferPool
+
 	// apply options
 	for _, opt := range opts {
 		opt(do)
 	}
-	logger.Debugf("Dial got final DialOption is: %+v", do)
+	logger.Debugf("Dialer.DialContext got final DialOption is: %+v", do)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
 
 	return dialWithContext(ctx, do)
 }
@@ -45,9 +111,15 @@ func Dial(URL string, opts ...DialOption) (*Conn, error) {
 var (
 	// ErrInvalidSchema .
 	ErrInvalidSchema = errors.New("invalid schema")
+	// ErrInvalidSubprotocol .
+	ErrInvalidSubprotocol = errors.New("websocket: server responded subprotocol not offered")
+	// ErrHandshakeHeader means the header which is set by handshake is set
+	// by caller, use options instead, e.g. WithSubprotocols.
+	ErrHandshakeHeader = errors.New("websocket: handshake header could not be set")
 )
 
-// dialWithContext to dail connection with server or client.
+// dialWithContext to dail connection with server or client, ctx bounds all I/O
+// of dialing, the connection is closed if dialing fails.
 // wsURL = "ws://host[:port]/path?rawquery"
 // wssURL = "wss://host[:port]/path?rawquery".
 //
@@ -56,7 +128,7 @@ var (
 // 2. send HTTP request to handshake and upgrade
 // 3. finish building WebSocket connection
 //
-func dialWithContext(ctx context.Context, do *options) (*Conn, error) {
+func dialWithContext(ctx context.Context, do *options) (*Conn, *http.Response, error) {
 	var (
 		schema string
 	)
@@ -67,106 +139,264 @@ func dialWithContext(ctx context.Context, do *options) (*Conn, error) {
 	case "wss":
 		schema = "https"
 	default:
-		return nil, ErrInvalidSchema
+		return nil, nil, ErrInvalidSchema
 	}
 
-	url := fmt.Sprintf("%s://%s:%s%s?%s", schema, do.host, do.port, do.path, do.rawquery)
-	logger.Debugf("http request url=%s", url)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	reqURL := fmt.Sprintf("%s://%s%s?%s", schema, net.JoinHostPort(do.host, do.port), do.path, do.rawquery)
+	logger.Debugf("http request url=%s", reqURL)
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
 	if err != nil {
 		logger.Errorf("dialWithContext failed to generate request, err=%v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// set headers, RFC6455 Section-4.1 page[17+]
 	reqHeaders := http.Header{}
 	reqHeaders.Add("Connection", "Upgrade")
-	reqHeaders.Add("Host", fmt.Sprintf("%s:%s", do.host, do.port))
+	reqHeaders.Add("Host", net.JoinHostPort(do.host, do.port))
 	reqHeaders.Add("Upgrade", "websocket")
 	reqHeaders.Add("Sec-WebSocket-Version", "13")
 	secKey, _ := generateChallengeKey()
 	reqHeaders.Add("Sec-WebSocket-Key", secKey)
+	if len(do.extensions) != 0 {
+		reqHeaders.Add("Sec-WebSocket-Extensions", offerExtensions(do.extensions))
+	}
+	if len(do.subprotocols) != 0 {
+		reqHeaders.Add("Sec-WebSocket-Protocol", strings.Join(do.subprotocols, ", "))
+	}
 	// copy reqHeaders into req.Header
 
+	for k, vs := range do.header {
+		switch k = http.CanonicalHeaderKey(k); k {
+		case "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version",
+			"Sec-Websocket-Extensions", "Sec-Websocket-Protocol":
+			return nil, nil, fmt.Errorf("%w: %s", ErrHandshakeHeader, k)
+		case "Host":
+			if len(vs) != 0 {
+				req.Host = vs[0]
+			}
+		default:
+			req.Header[k] = append(req.Header[k], vs...)
+		}
+	}
 	for k, v := range reqHeaders {
 		req.Header.Set(k, v[0])
 	}
+
+	// basic auth from userinfo of URL, unless Authorization is set
+	if do.user != nil && req.Header.Get("Authorization") == "" {
+		password, _ := do.user.Password()
+		req.SetBasicAuth(do.user.Username(), password)
+	}
+	if do.jar != nil {
+		for _, cookie := range do.jar.Cookies(req.URL) {
+			req.AddCookie(cookie)
+		}
+	}
 	logger.Debugf("dialWithContext send request with headers=%+v", req.Header)
 
 	// dial tcp conn
-	netconn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", do.host, do.port))
+	var netDial netDialerFunc = (&net.Dialer{}).DialContext
+	if do.netDialContext != nil {
+		netDial = do.netDialContext
+	}
+	if do.proxy != nil {
+		proxyURL, err := do.proxy(req)
+		if err != nil {
+			logger.Errorf("dialWithContext failed to get proxy, err=%v", err)
+			return nil, nil, err
+		}
+		if proxyURL != nil {
+			if netDial, err = proxyDialer(proxyURL, netDial); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	netconn, err := netDial(ctx, "tcp", net.JoinHostPort(do.host, do.port))
 	if err != nil {
 		logger.Errorf("dialWithContext failed to dial remote over TCP, err=%v", err)
-		return nil, err
+		return nil, nil, err
+	}
+
+	// interrupt TLS handshake and upgrade exchange once ctx is done
+	stop := watchDial(ctx, netconn)
+	conn, resp, err := upgradeConn(ctx, netconn, req, do)
+	if interrupted := stop(); interrupted && err != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = netconn.Close()
+		return nil, resp, err
+	}
+
+	conn.readLimit = do.maxMessageSize
+	conn.maxFrameSize = do.maxFrameSize
+	conn.writeFragmentSize = do.writeFragmentSize
+	conn.skipUTF8Validation = do.skipUTF8Validation
+	conn.setState(Connected)
+	conn.startKeepalive(do.keepalive)
+	return conn, resp, nil
+}
+
+// watchDial interrupts I/O of netconn once ctx is done, rather than setting
+// the deadline of ctx, so that the error is always reported as ctx.Err().
+// The returned stop must be called after I/O, it clears the deadline of
+// netconn and reports whether ctx has interrupted I/O.
+func watchDial(ctx context.Context, netconn net.Conn) (stop func() bool) {
+	var (
+		done        = make(chan struct{})
+		exited      = make(chan struct{})
+		interrupted bool
+	)
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			interrupted = true
+			// a time in the past makes pending I/O return immediately
+			_ = netconn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		<-exited
+		_ = netconn.SetDeadline(time.Time{})
+		return interrupted || ctx.Err() != nil
 	}
+}
 
+// upgradeConn makes TLS handshake if it's needed, then sends the upgrade
+// request and verifies the response.
+func upgradeConn(ctx context.Context, netconn net.Conn, req *http.Request, do *options) (*Conn, *http.Response, error) {
+	var err error
 	if do.needTLS() {
 		// true: TLS handshake
-		tlsconn := tls.Client(netconn, do.tlsConfig)
+		cfg := do.tlsConfig.Clone()
+		if cfg == nil {
+			cfg = new(tls.Config)
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = do.host
+		}
+		tlsconn := tls.Client(netconn, cfg)
 		netconn = tlsconn
-		if err = tlsHandshake(tlsconn, do.tlsConfig); err != nil {
-			logger.Errorf("dialWithContext TLS handshake, with tlsConfig=%+v err=%v", do.tlsConfig, err)
-			return nil, err
+		if err = tlsHandshake(tlsconn, cfg); err != nil {
+			logger.Errorf("dialWithContext TLS handshake, with tlsConfig=%+v err=%v", cfg, err)
+			return nil, nil, err
 		}
 	}
 
 	// handle newConn
-	conn, err := newConn(netconn, false)
+	conn, err := newConn(netconn, false, bufferOptions{
+		readBufferSize:  do.readBufferSize,
+		writeBufferSize: do.writeBufferSize,
+		writePool:       do.writeBufferPool,
+	})
 	if err != nil {
 		logger.Errorf("dialWithContext failed to newConn, err=%v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// with context
 	// send request and handshake
-	if err = req.WithContext(ctx).Write(conn.bufWR); err != nil {
+	bw := conn.getWriter()
+	if err = req.WithContext(ctx).Write(bw); err == nil {
+		err = bw.Flush()
+	}
+	conn.putWriter(bw)
+	if err != nil {
 		logger.Errorf("dialWithContext failed to write Upgrade Request, err=%v", err)
-		return nil, err
+		return nil, nil, err
 	}
-	_ = conn.bufWR.Flush()
 
 	// handle response
 	resp, err := http.ReadResponse(conn.bufRD, req)
 	if err != nil {
 		logger.Errorf("dialWithContext failed to read response, err=%v", err)
-		return nil, err
+		return nil, nil, err
 	}
 	logger.Debugf("dialWithContext got response status=%d headers=%+v", resp.StatusCode, resp.Header)
 
 	// verify response headers
-	if keep, err := shouldKeep(resp); !keep {
+	if err = verifyResponse(resp, req.Header.Get("Sec-WebSocket-Key")); err != nil {
 		logger.Errorf("dialWithContext could not open connection, err=%v", err)
-		return nil, err
+		return nil, resp, err
+	}
+
+	// store cookies even if server refuses later, as browsers do
+	if do.jar != nil {
+		if cookies := resp.Cookies(); len(cookies) != 0 {
+			do.jar.SetCookies(req.URL, cookies)
+		}
 	}
 
-	conn.State = Connected
-	return conn, nil
+	// verify negotiated extensions
+	if conn.extensions, err = configureExtensions(do.extensions, parseExtensions(resp.Header)); err != nil {
+		logger.Errorf("dialWithContext could not open connection, err=%v", err)
+		return nil, resp, err
+	}
+
+	// verify negotiated subprotocol
+	if conn.subprotocol, err = verifySubprotocol(do.subprotocols, resp.Header); err != nil {
+		logger.Errorf("dialWithContext could not open connection, err=%v", err)
+		return nil, resp, err
+	}
+
+	return conn, resp, nil
 }
 
-// shouldKeep to figure out: should client keep current websocket connection
-// related to status code and response headers
-func shouldKeep(resp *http.Response) (keep bool, err error) {
-	var body []byte
-	if body, err = ioutil.ReadAll(resp.Body); err != nil {
-		logger.Error("shouldKeep could not read response.Body")
-		return false, err
+// verifySubprotocol server MUST choose one of the offered subprotocols or none.
+func verifySubprotocol(offered []string, header http.Header) (string, error) {
+	protocols := parseSubprotocols(header)
+	switch len(protocols) {
+	case 0:
+		return "", nil
+	case 1:
+		for _, p := range offered {
+			if p == protocols[0] {
+				return p, nil
+			}
+		}
 	}
-	defer resp.Body.Close()
 
-	// check status
-	if resp.StatusCode != 101 {
-		err = fmt.Errorf("invalid status=%d, response=%s", resp.StatusCode, string(body))
-		return
+	return "", fmt.Errorf("%w: %v", ErrInvalidSubprotocol, protocols)
+}
+
+// maxHandshakeBodySize bounds the body of response carried by HandshakeError.
+const maxHandshakeBodySize = 1024
+
+// verifyResponse verifies the response of upgrade request according to
+// RFC6455 Section-4.1, secKey is the Sec-WebSocket-Key of request.
+func verifyResponse(resp *http.Response, secKey string) error {
+	newErr := func(text string) error {
+		err := HandshakeError{
+			Text:       "websocket: bad handshake: " + text,
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+		}
+		if resp.Body != nil {
+			err.Body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, maxHandshakeBodySize))
+			resp.Body = ioutil.NopCloser(bytes.NewReader(err.Body))
+		}
+		return err
 	}
 
-	// check headers
-	if h := resp.Header.Get("Sec-WebSocket-Accept"); h == "" {
-		err = fmt.Errorf("response=%s", string(body))
-		return
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return newErr("unexpected status " + resp.Status)
+	}
+	if !headerContainsToken(resp.Header, "Upgrade", "websocket") {
+		return newErr("'websocket' token not found in 'Upgrade' header")
+	}
+	if !headerContainsToken(resp.Header, "Connection", "upgrade") {
+		return newErr("'upgrade' token not found in 'Connection' header")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != computeAcceptKey(secKey) {
+		return newErr("mismatched 'Sec-WebSocket-Accept' header")
 	}
 
-	keep = true
-	return
+	return nil
 }
 
 func tlsHandshake(tlsconn *tls.Conn, cfg *tls.Config) error {
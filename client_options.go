@@ -1,7 +1,10 @@
 package websocket
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
+	"net/http"
 	"net/url"
 )
 
@@ -17,8 +20,44 @@ type options struct {
 	// rawquery contains parameters to build a connection
 	rawquery string
 
+	// header is sent along with the upgrade request
+	header http.Header
+	// user from userinfo of URL, it's sent as basic auth
+	user *url.Userinfo
+	// jar of cookies, see Dialer.Jar
+	jar http.CookieJar
+
+	// netDialContext dials TCP connection, see Dialer.NetDialContext
+	netDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// proxy returns the proxy URL, see Dialer.Proxy
+	proxy func(*http.Request) (*url.URL, error)
+
 	// tlsConfig with TLS config or not
 	tlsConfig *tls.Config
+
+	// extensions to offer to server
+	extensions []Extension
+
+	// subprotocols to offer to server, in order of preference
+	subprotocols []string
+
+	// keepalive of Conn, it's disabled by default
+	keepalive KeepaliveOptions
+
+	// read limits of message and frame, 0 means no limit
+	maxMessageSize int64
+	maxFrameSize   int64
+
+	// buffers of Conn, see Upgrader.ReadBufferSize
+	readBufferSize  int
+	writeBufferSize int
+	writeBufferPool BufferPool
+
+	// writeFragmentSize of outgoing messages, see Conn.SetWriteFragmentSize
+	writeFragmentSize int
+
+	// skipUTF8Validation skips validating text messages and close reasons
+	skipUTF8Validation bool
 }
 
 func (o options) needTLS() bool {
@@ -41,6 +80,7 @@ func parseURL(URL string) (*options, error) {
 		port:     u.Port(),
 		path:     u.Path,
 		rawquery: u.RawQuery,
+		user:     u.User,
 	}
 
 	if do.port == "" {
@@ -69,3 +109,124 @@ func WithTLS(cfg *tls.Config) DialOption {
 		do.tlsConfig = cfg
 	}
 }
+
+// WithHeader generate DialOption to send header along with the upgrade request,
+// e.g. Authorization, Origin or tracing headers. Headers set by handshake
+// could not be set, e.g. Sec-WebSocket-Protocol, use options instead. Host
+// overrides the host of URL.
+func WithHeader(header http.Header) DialOption {
+	return func(do *options) {
+		merged := make(http.Header, len(do.header)+len(header))
+		for k, vs := range do.header {
+			merged[k] = append(merged[k], vs...)
+		}
+		for k, vs := range header {
+			merged[k] = append(merged[k], vs...)
+		}
+		do.header = merged
+	}
+}
+
+// WithProxy generate DialOption to connect through the proxy returned by
+// proxy, e.g. http.ProxyFromEnvironment. See Dialer.Proxy.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) DialOption {
+	return func(do *options) {
+		do.proxy = proxy
+	}
+}
+
+// WithCookieJar generate DialOption to send cookies from jar along with the
+// upgrade request, and store cookies from the response into jar.
+func WithCookieJar(jar http.CookieJar) DialOption {
+	return func(do *options) {
+		do.jar = jar
+	}
+}
+
+// WithCompression generate DialOption to offer permessage-deflate extension
+// (RFC7692) to server, compression is enabled only if server accepts it.
+func WithCompression(opt CompressionOptions) DialOption {
+	return func(do *options) {
+		do.extensions = append(do.extensions, newPermessageDeflate(opt))
+	}
+}
+
+// WithExtensions generate DialOption to offer extensions to server, the
+// offers keep the same order as exts.
+func WithExtensions(exts ...Extension) DialOption {
+	return func(do *options) {
+		do.extensions = append(do.extensions, exts...)
+	}
+}
+
+// WithSubprotocols generate DialOption to offer subprotocols to server by
+// Sec-WebSocket-Protocol, in order of preference.
+func WithSubprotocols(protocols ...string) DialOption {
+	return func(do *options) {
+		do.subprotocols = append(do.subprotocols, protocols...)
+	}
+}
+
+// WithKeepalive generate DialOption to send ping while Conn is idle, and close
+// Conn if server does not respond in time.
+func WithKeepalive(opt KeepaliveOptions) DialOption {
+	return func(do *options) {
+		do.keepalive = opt
+	}
+}
+
+// WithMaxMessageSize generate DialOption to set the read limit of Conn,
+// see Conn.SetReadLimit.
+func WithMaxMessageSize(n int64) DialOption {
+	return func(do *options) {
+		do.maxMessageSize = n
+	}
+}
+
+// WithMaxFrameSize generate DialOption to limit the size of frame payload from
+// server, the Conn is closed with CloseMessageTooBig if it's exceeded.
+func WithMaxFrameSize(n int64) DialOption {
+	return func(do *options) {
+		do.maxFrameSize = n
+	}
+}
+
+// WithWriteFragmentSize generate DialOption to set the max payload size of each
+// frame of messages sent by client, see Conn.SetWriteFragmentSize.
+func WithWriteFragmentSize(n int) DialOption {
+	return func(do *options) {
+		do.writeFragmentSize = n
+	}
+}
+
+// WithReadBufferSize generate DialOption to set the size of read buffer,
+// 0 means 64KB.
+func WithReadBufferSize(n int) DialOption {
+	return func(do *options) {
+		do.readBufferSize = n
+	}
+}
+
+// WithWriteBufferSize generate DialOption to set the size of write buffer,
+// 0 means 4KB.
+func WithWriteBufferSize(n int) DialOption {
+	return func(do *options) {
+		do.writeBufferSize = n
+	}
+}
+
+// WithWriteBufferPool generate DialOption to borrow write buffers from pool
+// only while frames are being written, see Upgrader.WriteBufferPool.
+func WithWriteBufferPool(pool BufferPool) DialOption {
+	return func(do *options) {
+		do.writeBufferPool = pool
+	}
+}
+
+// WithSkipUTF8Validation generate DialOption to skip validating text messages
+// and close reasons from server, it's for trusted servers.
+func WithSkipUTF8Validation() DialOption {
+	return func(do *options) {
+		do.skipUTF8Validation = true
+	}
+}
@@ -2,7 +2,11 @@ package websocket
 
 import (
 	"crypto/tls"
+	"net/http"
+	"net/http/cookiejar"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -93,3 +97,80 @@ func TestWithTLS(t *testing.T) {
 
 	assert.Equal(t, tlsConfig, do.tlsConfig)
 }
+
+func TestWithSubprotocols(t *testing.T) {
+	do := options{}
+	WithSubprotocols("chat", "superchat")(&do)
+	WithSubprotocols("mqtt")(&do)
+
+	assert.Equal(t, []string{"chat", "superchat", "mqtt"}, do.subprotocols)
+}
+
+func TestWithKeepalive(t *testing.T) {
+	do := options{}
+	opt := KeepaliveOptions{Interval: time.Second, Timeout: 2 * time.Second}
+	WithKeepalive(opt)(&do)
+
+	assert.Equal(t, opt, do.keepalive)
+}
+
+func TestWithMaxMessageSize(t *testing.T) {
+	do := options{}
+	WithMaxMessageSize(1024)(&do)
+	WithMaxFrameSize(512)(&do)
+
+	assert.Equal(t, int64(1024), do.maxMessageSize)
+	assert.Equal(t, int64(512), do.maxFrameSize)
+}
+
+func TestWithSkipUTF8Validation(t *testing.T) {
+	do := options{}
+	WithSkipUTF8Validation()(&do)
+
+	assert.True(t, do.skipUTF8Validation)
+}
+
+func TestWithWriteFragmentSize(t *testing.T) {
+	do := options{}
+	WithWriteFragmentSize(NoFragmentation)(&do)
+
+	assert.Equal(t, NoFragmentation, do.writeFragmentSize)
+}
+
+func TestWithBufferSize(t *testing.T) {
+	do := options{}
+	pool := &sync.Pool{}
+	WithReadBufferSize(1024)(&do)
+	WithWriteBufferSize(512)(&do)
+	WithWriteBufferPool(pool)(&do)
+
+	assert.Equal(t, 1024, do.readBufferSize)
+	assert.Equal(t, 512, do.writeBufferSize)
+	assert.True(t, pool == do.writeBufferPool)
+}
+
+func TestWithHeader(t *testing.T) {
+	header := http.Header{"Origin": {"http://example.com"}}
+	do := options{header: header}
+	WithHeader(http.Header{"Origin": {"http://foo.com"}, "X-Trace-Id": {"1"}})(&do)
+
+	assert.Equal(t, []string{"http://example.com", "http://foo.com"}, do.header["Origin"])
+	assert.Equal(t, []string{"1"}, do.header["X-Trace-Id"])
+	// header of caller is not modified
+	assert.Equal(t, []string{"http://example.com"}, header["Origin"])
+}
+
+func TestWithCookieJar(t *testing.T) {
+	do := options{}
+	jar, _ := cookiejar.New(nil)
+	WithCookieJar(jar)(&do)
+
+	assert.True(t, jar == do.jar)
+}
+
+func TestWithProxy(t *testing.T) {
+	do := options{}
+	WithProxy(http.ProxyFromEnvironment)(&do)
+
+	assert.NotNil(t, do.proxy)
+}
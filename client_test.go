@@ -1,13 +1,31 @@
 package websocket
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_dialWithContext(t *testing.T) {
-	// go startWebsocketServer()
+	startEchoServer()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -19,13 +37,83 @@ func Test_dialWithContext(t *testing.T) {
 		rawquery: "",
 	}
 
-	_, err := dialWithContext(ctx, do)
+	_, _, err := dialWithContext(ctx, do)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
 }
 
+func Test_verifySubprotocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		offered []string
+		respond []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "case 0: none",
+			offered: []string{"chat"},
+			respond: nil,
+			want:    "",
+		},
+		{
+			name:    "case 1",
+			offered: []string{"chat", "superchat"},
+			respond: []string{"superchat"},
+			want:    "superchat",
+		},
+		{
+			name:    "case 2: not offered",
+			offered: []string{"chat"},
+			respond: []string{"mqtt"},
+			wantErr: true,
+		},
+		{
+			name:    "case 3: more than one",
+			offered: []string{"chat", "superchat"},
+			respond: []string{"chat, superchat"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, v := range tt.respond {
+				header.Add("Sec-WebSocket-Protocol", v)
+			}
+			got, err := verifySubprotocol(tt.offered, header)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_Dial_Subprotocol(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{Subprotocols: []string{"mqtt", "chat"}})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL, WithSubprotocols("superchat", "chat", "mqtt"))
+	require.Nil(t, err)
+	assert.Equal(t, "chat", conn.Subprotocol())
+
+	conn, err = Dial(wsURL, WithSubprotocols("superchat"))
+	require.Nil(t, err)
+	assert.Equal(t, "", conn.Subprotocol())
+
+	srv2, wsURL2 := newEchoServer(Upgrader{
+		SelectSubprotocol: func(req *http.Request, offered []string) string {
+			return offered[len(offered)-1]
+		},
+	})
+	defer srv2.Close()
+
+	conn, err = Dial(wsURL2, WithSubprotocols("chat", "mqtt"))
+	require.Nil(t, err)
+	assert.Equal(t, "mqtt", conn.Subprotocol())
+}
+
 // func Test_sendAndRecv(t *testing.T) {
 // 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 // 	defer cancel()
@@ -58,3 +146,263 @@ func Test_dialWithContext(t *testing.T) {
 // 		t.FailNow()
 // 	}
 // }
+
+func Test_Dial_BufferSize(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{
+		ReadBufferSize:  minReadBufferSize,
+		WriteBufferSize: minReadBufferSize,
+		WriteBufferPool: &sync.Pool{},
+	})
+	defer srv.Close()
+
+	pool := &sync.Pool{}
+	conn, err := Dial(wsURL,
+		WithReadBufferSize(minReadBufferSize),
+		WithWriteBufferSize(512),
+		WithWriteBufferPool(pool),
+	)
+	require.Nil(t, err)
+	defer conn.Close()
+	assert.Nil(t, conn.bufWR)
+
+	data := make([]byte, 70000)
+	rand.Read(data)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, conn.WriteMessage(BinaryMessage, data))
+		mt, msg, err := conn.ReadMessage()
+		require.Nil(t, err)
+		assert.Equal(t, BinaryMessage, mt)
+		assert.Equal(t, data, msg)
+	}
+}
+
+func Test_Dialer_DialContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = Upgrader{}.Upgrade(w, req, func(conn *Conn) {
+			_ = conn.SendMessage(req.Header.Get("X-Trace-Id"))
+			_, _, _ = conn.ReadMessage()
+		})
+	}))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	var dialed string
+	d := Dialer{
+		HandshakeTimeout: time.Second,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = addr
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+		ReadBufferSize: 1024,
+	}
+	conn, resp, err := d.DialContext(context.Background(), wsURL, http.Header{"X-Trace-Id": {"abc"}})
+	require.Nil(t, err)
+	defer conn.Close()
+	assert.Equal(t, strings.TrimPrefix(srv.URL, "http://"), dialed)
+	assert.Equal(t, 1024, conn.bufRD.Size())
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	_, msg, err := conn.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "abc", string(msg))
+}
+
+func Test_Dialer_DialContext_TLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = Upgrader{}.Upgrade(w, req, func(conn *Conn) {
+			_ = conn.SendMessage("secure")
+			_, _, _ = conn.ReadMessage()
+		})
+	}))
+	defer srv.Close()
+	wsURL := "wss" + strings.TrimPrefix(srv.URL, "https")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	d := Dialer{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	conn, _, err := d.DialContext(context.Background(), wsURL, nil)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, msg, err := conn.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "secure", string(msg))
+
+	// server is not trusted
+	_, _, err = (&Dialer{}).DialContext(context.Background(), wsURL, nil)
+	assert.Error(t, err)
+}
+
+func Test_Dialer_DialContext_canceled(t *testing.T) {
+	// server accepts the connection but never responds
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	wsURL := "ws://" + ln.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err = (&Dialer{}).DialContext(ctx, wsURL, nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	d := Dialer{HandshakeTimeout: 50 * time.Millisecond}
+	_, _, err = d.DialContext(context.Background(), wsURL, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func Test_Dial_Header(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = Upgrader{}.Upgrade(w, req, func(conn *Conn) {
+			user, password, _ := req.BasicAuth()
+			cookie, _ := req.Cookie("session")
+			for _, s := range []string{
+				user + ":" + password,
+				req.Header.Get("Origin"),
+				strings.Join(req.Header["X-Trace-Id"], ","),
+				cookie.String(),
+				req.Host,
+			} {
+				_ = conn.SendMessage(s)
+			}
+			_, _, _ = conn.ReadMessage()
+		})
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	wsURL := "ws://foo:bar@" + u.Host
+
+	jar, _ := cookiejar.New(nil)
+	jar.SetCookies(&url.URL{Scheme: "http", Host: u.Host}, []*http.Cookie{{Name: "session", Value: "s1"}})
+	d := Dialer{Jar: jar}
+	conn, _, err := d.DialContext(context.Background(), wsURL, http.Header{"X-Trace-Id": {"1"}},
+		WithHeader(http.Header{"Origin": {"http://example.com"}, "X-Trace-Id": {"2"}, "Host": {"example.com"}}),
+	)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	for _, want := range []string{"foo:bar", "http://example.com", "1,2", "session=s1", "example.com"} {
+		_, msg, err := conn.ReadMessage()
+		require.Nil(t, err)
+		assert.Equal(t, want, string(msg))
+	}
+}
+
+func Test_Dial_HandshakeHeader(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{})
+	defer srv.Close()
+
+	for _, key := range []string{"upgrade", "Sec-WebSocket-Key", "Sec-WebSocket-Protocol"} {
+		_, err := Dial(wsURL, WithHeader(http.Header{key: {"x"}}))
+		assert.True(t, errors.Is(err, ErrHandshakeHeader), key)
+	}
+}
+
+func Test_Dial_CookieJar(t *testing.T) {
+	// server sets cookie in the 101 response
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\nSet-Cookie: session=s2\r\n\r\n",
+			computeAcceptKey(req.Header.Get("Sec-WebSocket-Key")))
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+
+	jar, _ := cookiejar.New(nil)
+	conn, err := Dial("ws://"+ln.Addr().String(), WithCookieJar(jar))
+	require.Nil(t, err)
+	// server never replies close frame
+	conn.SetCloseTimeout(10 * time.Millisecond)
+	defer conn.Close()
+
+	cookies := jar.Cookies(&url.URL{Scheme: "http", Host: ln.Addr().String()})
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "s2", cookies[0].Value)
+}
+
+func Test_verifyResponse(t *testing.T) {
+	secKey := "dGhlIHNhbXBsZSBub25jZQ=="
+	newResp := func(status int, header http.Header, body string) *http.Response {
+		return &http.Response{
+			Status:     http.StatusText(status),
+			StatusCode: status,
+			Header:     header,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+	}
+	valid := func() http.Header {
+		return http.Header{
+			"Upgrade":              {"WebSocket"},
+			"Connection":           {"keep-alive, UPGRADE"},
+			"Sec-Websocket-Accept": {"s3pPLMBiTxaQ9kYGzzhZRbK+xOo="},
+		}
+	}
+
+	// tokens are case-insensitive
+	assert.Nil(t, verifyResponse(newResp(http.StatusSwitchingProtocols, valid(), ""), secKey))
+
+	header := valid()
+	header.Set("Sec-WebSocket-Accept", "bogus")
+	err := verifyResponse(newResp(http.StatusSwitchingProtocols, header, ""), secKey)
+	assert.IsType(t, HandshakeError{}, err)
+
+	header = valid()
+	header.Set("Upgrade", "h2c")
+	err = verifyResponse(newResp(http.StatusSwitchingProtocols, header, ""), secKey)
+	assert.IsType(t, HandshakeError{}, err)
+
+	header = valid()
+	header.Del("Connection")
+	err = verifyResponse(newResp(http.StatusSwitchingProtocols, header, ""), secKey)
+	assert.IsType(t, HandshakeError{}, err)
+
+	// body is bounded
+	resp := newResp(http.StatusForbidden, http.Header{"X-Reason": {"denied"}}, strings.Repeat("a", 2*maxHandshakeBodySize))
+	err = verifyResponse(resp, secKey)
+	herr, ok := err.(HandshakeError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusForbidden, herr.StatusCode)
+	assert.Equal(t, "denied", herr.Header.Get("X-Reason"))
+	assert.Equal(t, maxHandshakeBodySize, len(herr.Body))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, herr.Body, body)
+}
+
+func Test_Dialer_DialContext_handshakeError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Reason", "denied")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("login required"))
+	}))
+	defer srv.Close()
+
+	_, resp, err := (&Dialer{}).DialContext(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	herr, ok := err.(HandshakeError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, herr.StatusCode)
+	assert.Equal(t, "login required", string(herr.Body))
+	require.NotNil(t, resp)
+	assert.Equal(t, "denied", resp.Header.Get("X-Reason"))
+}
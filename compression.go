@@ -0,0 +1,402 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+// permessage-deflate extension, RFC7692
+// https://tools.ietf.org/html/rfc7692
+const (
+	extPermessageDeflate = "permessage-deflate"
+
+	paramServerNoContextTakeover = "server_no_context_takeover"
+	paramClientNoContextTakeover = "client_no_context_takeover"
+	paramServerMaxWindowBits     = "server_max_window_bits"
+	paramClientMaxWindowBits     = "client_max_window_bits"
+
+	// compress/flate always uses the 32KB LZ77 window (2^15), so that
+	// the compressor could not work with a smaller window.
+	maxWindowBits = 15
+	minWindowBits = 8
+)
+
+var (
+	// deflateTail is appended to compressed message to make up the
+	// the empty non-compressed block, RFC7692 Section-7.2.2
+	deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+	// deflateFinalBlock is an empty final block to terminate the
+	// flate.Reader without io.ErrUnexpectedEOF.
+	deflateFinalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+	// ErrInvalidCompression .
+	ErrInvalidCompression = errors.New("websocket: invalid compression negotiation")
+)
+
+// CompressionOptions to configure permessage-deflate extension.
+type CompressionOptions struct {
+	// Level is the compression level passed to compress/flate,
+	// 0 means flate.DefaultCompression.
+	Level int
+
+	// ServerNoContextTakeover server MUST reset the compression context
+	// after each message.
+	ServerNoContextTakeover bool
+
+	// ClientNoContextTakeover client MUST reset the compression context
+	// after each message.
+	ClientNoContextTakeover bool
+}
+
+func (opt CompressionOptions) level() int {
+	if opt.Level == 0 {
+		return flate.DefaultCompression
+	}
+	return opt.Level
+}
+
+// parseWindowBits parse and validate xxx_max_window_bits value.
+func parseWindowBits(v string) (int, error) {
+	bits, err := strconv.Atoi(v)
+	if err != nil || bits < minWindowBits || bits > maxWindowBits {
+		return 0, fmt.Errorf("%w: invalid window bits=%s", ErrInvalidCompression, v)
+	}
+	return bits, nil
+}
+
+// permessageDeflate implements Extension. As a template it only holds
+// CompressionOptions, after negotiation it holds negotiated parameters and
+// the compression context of one Conn.
+type permessageDeflate struct {
+	opt CompressionOptions
+
+	isServer bool
+	level    int
+
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+
+	// writeCompression marks whether to compress outgoing messages.
+	writeCompression bool
+	// compressing and decompressing mark whether current message is
+	// compressed or not, since only the first frame carries RSV1.
+	compressing   bool
+	decompressing bool
+
+	fw    *flate.Writer
+	fwBuf *bytes.Buffer
+	fr    io.ReadCloser
+	frRD  *bufio.Reader
+	frBuf []byte
+	// decodeLimit bounds the decompressed message in DecodeFrame, see
+	// decodeLimiter.
+	decodeLimit int64
+	// dict holds the decompressed data of previous messages, the last 32KB
+	// of it is the dictionary of next message.
+	dict []byte
+}
+
+func newPermessageDeflate(opt CompressionOptions) *permessageDeflate {
+	return &permessageDeflate{opt: opt}
+}
+
+// instance creates the permessageDeflate of Conn from template.
+func (pmd *permessageDeflate) instance(isServer bool) *permessageDeflate {
+	return &permessageDeflate{
+		opt:                     pmd.opt,
+		isServer:                isServer,
+		level:                   pmd.opt.level(),
+		serverNoContextTakeover: pmd.opt.ServerNoContextTakeover,
+		clientNoContextTakeover: pmd.opt.ClientNoContextTakeover,
+		writeCompression:        true,
+		decodeLimit:             -1,
+	}
+}
+
+func (pmd *permessageDeflate) Name() string {
+	return extPermessageDeflate
+}
+
+// Offer never offers client_max_window_bits, since the compressor could
+// not work with a smaller window.
+func (pmd *permessageDeflate) Offer() ExtensionParams {
+	params := make(ExtensionParams)
+	if pmd.opt.ServerNoContextTakeover {
+		params[paramServerNoContextTakeover] = ""
+	}
+	if pmd.opt.ClientNoContextTakeover {
+		params[paramClientNoContextTakeover] = ""
+	}
+	return params
+}
+
+func (pmd *permessageDeflate) Accept(offer ExtensionParams) (ExtensionParams, Extension) {
+	p := pmd.instance(true)
+
+	// server_max_window_bits MUST be responded if client offers it,
+	// RFC7692 Section-7.1.2.1
+	var serverMaxWindowBits bool
+	for k, v := range offer {
+		switch k {
+		case paramServerNoContextTakeover:
+			if v != "" {
+				return nil, nil
+			}
+			p.serverNoContextTakeover = true
+		case paramClientNoContextTakeover:
+			if v != "" {
+				return nil, nil
+			}
+			p.clientNoContextTakeover = true
+		case paramServerMaxWindowBits:
+			// server could not limit the window of compressor.
+			bits, err := parseWindowBits(v)
+			if err != nil || bits < maxWindowBits {
+				return nil, nil
+			}
+			serverMaxWindowBits = true
+		case paramClientMaxWindowBits:
+			// client supports the hint, but the decompressor could work
+			// with any window size, so nothing to respond.
+			if v != "" {
+				if _, err := parseWindowBits(v); err != nil {
+					return nil, nil
+				}
+			}
+		default:
+			// unknown parameter, decline the offer.
+			return nil, nil
+		}
+	}
+
+	params := make(ExtensionParams)
+	if p.serverNoContextTakeover {
+		params[paramServerNoContextTakeover] = ""
+	}
+	if p.clientNoContextTakeover {
+		params[paramClientNoContextTakeover] = ""
+	}
+	if serverMaxWindowBits {
+		params[paramServerMaxWindowBits] = strconv.Itoa(maxWindowBits)
+	}
+	return params, p
+}
+
+func (pmd *permessageDeflate) Configure(resp ExtensionParams) (Extension, error) {
+	p := pmd.instance(false)
+	// server could not make client context takeover if client has asked.
+	p.serverNoContextTakeover = false
+
+	for k, v := range resp {
+		switch k {
+		case paramServerNoContextTakeover:
+			p.serverNoContextTakeover = true
+		case paramClientNoContextTakeover:
+			p.clientNoContextTakeover = true
+		case paramServerMaxWindowBits:
+			// the decompressor could work with any window size.
+			if _, err := parseWindowBits(v); err != nil {
+				return nil, err
+			}
+		default:
+			// client_max_window_bits is never offered, so server
+			// MUST NOT respond it.
+			return nil, fmt.Errorf("%w: unexpected parameter=%s", ErrInvalidCompression, k)
+		}
+	}
+
+	return p, nil
+}
+
+func (pmd *permessageDeflate) RSV() uint16 {
+	return RSV1Bit
+}
+
+// EncodeFrame compresses the payload of each frame, and sets RSV1 on the
+// first frame of compressed message.
+func (pmd *permessageDeflate) EncodeFrame(frm *Frame) (err error) {
+	switch frm.OpCode {
+	case OpCodeText, OpCodeBinary:
+		pmd.compressing = pmd.writeCompression
+		if pmd.compressing {
+			frm.RSV1 = 1
+		}
+	case OpCodeContinuation:
+	default:
+		return nil
+	}
+
+	if !pmd.compressing {
+		return nil
+	}
+
+	frm.Payload, err = pmd.compress(frm.Payload, frm.isFinal())
+	return err
+}
+
+// DecodeFrame collects compressed payload until the final frame comes,
+// then decompresses the whole message into the final frame.
+func (pmd *permessageDeflate) DecodeFrame(frm *Frame) error {
+	switch frm.OpCode {
+	case OpCodeText, OpCodeBinary:
+		pmd.decompressing = frm.RSV1 == 1
+		pmd.frBuf = pmd.frBuf[:0]
+	case OpCodeContinuation:
+		if frm.RSV1 == 1 {
+			return newInvalidFrameError("RSV1 set on continuation frame")
+		}
+	default:
+		return nil
+	}
+
+	if !pmd.decompressing {
+		return nil
+	}
+
+	pmd.frBuf = append(pmd.frBuf, frm.Payload...)
+	if !frm.isFinal() {
+		frm.Payload = nil
+		return nil
+	}
+
+	p, err := pmd.decompress(pmd.frBuf, pmd.decodeLimit)
+	if err != nil {
+		return &CloseError{Code: CloseInvalidFramePayloadData, Text: err.Error()}
+	}
+	frm.Payload = p
+	pmd.frBuf = pmd.frBuf[:0]
+	return nil
+}
+
+// compressNoContextTakeover returns whether the compressor of current side
+// should reset context after each message.
+func (pmd *permessageDeflate) compressNoContextTakeover() bool {
+	if pmd.isServer {
+		return pmd.serverNoContextTakeover
+	}
+	return pmd.clientNoContextTakeover
+}
+
+// decompressNoContextTakeover returns whether the compressor of other side
+// resets context after each message.
+func (pmd *permessageDeflate) decompressNoContextTakeover() bool {
+	if pmd.isServer {
+		return pmd.clientNoContextTakeover
+	}
+	return pmd.serverNoContextTakeover
+}
+
+// compress a part of message, the tail 0x00 0x00 0xff 0xff is removed
+// from the final part.
+func (pmd *permessageDeflate) compress(data []byte, final bool) ([]byte, error) {
+	var err error
+	if pmd.fw == nil {
+		pmd.fwBuf = bytes.NewBuffer(nil)
+		if pmd.fw, err = flate.NewWriter(pmd.fwBuf, pmd.level); err != nil {
+			return nil, err
+		}
+	}
+
+	pmd.fwBuf.Reset()
+	if _, err = pmd.fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err = pmd.fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	p := pmd.fwBuf.Bytes()
+	if final {
+		if !bytes.HasSuffix(p, deflateTail) {
+			return nil, errors.New("websocket: compressed data without tail")
+		}
+		p = p[:len(p)-len(deflateTail)]
+		if pmd.compressNoContextTakeover() {
+			pmd.fw.Reset(pmd.fwBuf)
+		}
+	}
+
+	out := make([]byte, len(p))
+	copy(out, p)
+	return out, nil
+}
+
+// decodeStream decompresses the message on the fly if RSV1 is set on its
+// first frame.
+func (pmd *permessageDeflate) decodeStream(frm *Frame, payload io.Reader) (io.Reader, error) {
+	if frm.RSV1 != 1 {
+		return nil, nil
+	}
+	return pmd.inflate(payload)
+}
+
+func (pmd *permessageDeflate) limitDecode(n int64) {
+	pmd.decodeLimit = n
+}
+
+// decompress a whole message, at most limit+1 bytes are decompressed so that
+// caller could find it's over the limit, negative limit means no limit.
+func (pmd *permessageDeflate) decompress(data []byte, limit int64) ([]byte, error) {
+	r, err := pmd.inflate(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if limit >= 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	return ioutil.ReadAll(r)
+}
+
+// inflate returns the reader of decompressed message, the compressed message
+// is read from r.
+func (pmd *permessageDeflate) inflate(r io.Reader) (io.Reader, error) {
+	r = io.MultiReader(
+		r,
+		bytes.NewReader(deflateTail),
+		bytes.NewReader(deflateFinalBlock),
+	)
+	if pmd.frRD == nil {
+		pmd.frRD = bufio.NewReader(r)
+	} else {
+		pmd.frRD.Reset(r)
+	}
+
+	if pmd.decompressNoContextTakeover() {
+		pmd.dict = nil
+	}
+	if n := len(pmd.dict) - (1 << maxWindowBits); n > 0 {
+		pmd.dict = append(pmd.dict[:0], pmd.dict[n:]...)
+	}
+	if pmd.fr == nil {
+		pmd.fr = flate.NewReaderDict(pmd.frRD, pmd.dict)
+	} else if err := pmd.fr.(flate.Resetter).Reset(pmd.frRD, pmd.dict); err != nil {
+		return nil, err
+	}
+
+	return inflateReader{pmd: pmd}, nil
+}
+
+// inflateReader reads decompressed message, and keeps it as the dictionary
+// of next message if context takeover is allowed.
+type inflateReader struct {
+	pmd *permessageDeflate
+}
+
+func (r inflateReader) Read(p []byte) (int, error) {
+	n, err := r.pmd.fr.Read(p)
+	if n != 0 && !r.pmd.decompressNoContextTakeover() {
+		// the dictionary is trimmed to the last 32KB once it's doubled, so
+		// that it's not copied on every read.
+		r.pmd.dict = append(r.pmd.dict, p[:n]...)
+		if m := len(r.pmd.dict) - (1 << maxWindowBits); m > 1<<maxWindowBits {
+			r.pmd.dict = append(r.pmd.dict[:0], r.pmd.dict[m:]...)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,243 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_permessageDeflate_Accept(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   ExtensionParams
+		opt      CompressionOptions
+		wantOK   bool
+		wantResp string
+	}{
+		{
+			name:     "case 0",
+			params:   ExtensionParams{},
+			wantOK:   true,
+			wantResp: "permessage-deflate",
+		},
+		{
+			name:     "case 1",
+			params:   ExtensionParams{paramClientMaxWindowBits: "", paramClientNoContextTakeover: ""},
+			opt:      CompressionOptions{ServerNoContextTakeover: true},
+			wantOK:   true,
+			wantResp: "permessage-deflate; client_no_context_takeover; server_no_context_takeover",
+		},
+		{
+			name:   "case 2: could not limit server window",
+			params: ExtensionParams{paramServerMaxWindowBits: "10"},
+			wantOK: false,
+		},
+		{
+			name:     "case 3: server_max_window_bits is responded",
+			params:   ExtensionParams{paramServerMaxWindowBits: "15"},
+			wantOK:   true,
+			wantResp: "permessage-deflate; server_max_window_bits=15",
+		},
+		{
+			name:   "case 4: unknown parameter",
+			params: ExtensionParams{"foo": "bar"},
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, ext := newPermessageDeflate(tt.opt).Accept(tt.params)
+			assert.Equal(t, tt.wantOK, ext != nil)
+			if ext != nil {
+				assert.Equal(t, tt.wantResp, formatExtension(extPermessageDeflate, params))
+			}
+		})
+	}
+}
+
+func Test_permessageDeflate_Configure(t *testing.T) {
+	ext, err := newPermessageDeflate(CompressionOptions{}).
+		Configure(ExtensionParams{paramServerNoContextTakeover: ""})
+	require.Nil(t, err)
+	pmd := ext.(*permessageDeflate)
+	assert.True(t, pmd.decompressNoContextTakeover())
+	assert.False(t, pmd.compressNoContextTakeover())
+
+	_, err = newPermessageDeflate(CompressionOptions{}).
+		Configure(ExtensionParams{paramClientMaxWindowBits: "10"})
+	assert.Error(t, err)
+}
+
+func Test_permessageDeflate_compress(t *testing.T) {
+	for _, noContextTakeover := range []bool{true, false} {
+		opt := CompressionOptions{ClientNoContextTakeover: noContextTakeover}
+		client := newPermessageDeflate(opt).instance(false)
+		server := newPermessageDeflate(opt).instance(true)
+
+		for i := 0; i < 3; i++ {
+			msg := []byte(strings.Repeat("hello websocket ", 1024))
+			// compress in two parts as two frames
+			compressed, err := client.compress(msg[:100], false)
+			require.Nil(t, err)
+			p, err := client.compress(msg[100:], true)
+			require.Nil(t, err)
+			compressed = append(compressed, p...)
+			assert.Less(t, len(compressed), len(msg))
+
+			decompressed, err := server.decompress(compressed, -1)
+			require.Nil(t, err)
+			assert.Equal(t, msg, decompressed)
+		}
+	}
+}
+
+func Test_Conn_Compression(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{EnableCompression: true})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL, WithCompression(CompressionOptions{}))
+	require.Nil(t, err)
+	require.Equal(t, []string{extPermessageDeflate}, conn.Extensions())
+
+	for _, enable := range []bool{true, false, true} {
+		conn.EnableWriteCompression(enable)
+		text := strings.Repeat("compression ", 10000)
+		require.Nil(t, conn.SendMessage(text))
+
+		mt, msg, err := conn.ReadMessage()
+		require.Nil(t, err)
+		assert.Equal(t, TextMessage, mt)
+		assert.Equal(t, text, string(msg))
+	}
+}
+
+func Test_Conn_EnableWriteCompression_concurrent(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{EnableCompression: true})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL, WithCompression(CompressionOptions{}))
+	require.Nil(t, err)
+	defer conn.Close()
+
+	// toggling compression while sending is safe, each message is either
+	// compressed or not as a whole.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			conn.EnableWriteCompression(i%2 == 0)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		require.Nil(t, conn.SendMessage("toggle"))
+		_, msg, err := conn.ReadMessage()
+		require.Nil(t, err)
+		assert.Equal(t, "toggle", string(msg))
+	}
+	<-done
+}
+
+func Test_Conn_Compression_streaming(t *testing.T) {
+	// the first part of message is read before the rest is sent, so that the
+	// compressed message is decompressed on the fly rather than buffered.
+	part := []byte(strings.Repeat("streaming ", 10000))
+	firstRead := make(chan struct{})
+	srv, wsURL := newTestServer(Upgrader{EnableCompression: true}, func(conn *Conn) {
+		w, err := conn.NextWriter(TextMessage)
+		if err != nil {
+			return
+		}
+		_, _ = w.Write(part)
+		<-firstRead
+		_, _ = w.Write(part)
+		_ = w.Close()
+		_, _, _ = conn.ReadMessage()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL, WithCompression(CompressionOptions{}))
+	require.Nil(t, err)
+	defer conn.Close()
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	mt, r, err := conn.NextReader()
+	require.Nil(t, err)
+	assert.Equal(t, TextMessage, mt)
+	p := make([]byte, 1000)
+	_, err = io.ReadFull(r, p)
+	require.Nil(t, err)
+	assert.Equal(t, part[:1000], p)
+	close(firstRead)
+
+	rest, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	assert.Equal(t, append(part[1000:], part...), rest)
+}
+
+func Test_Conn_Compression_continuationRSV1(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+	conn.isServer = false
+	conn.extensions = []Extension{newPermessageDeflate(CompressionOptions{}).instance(false)}
+
+	// RSV1 is only allowed on the first frame of message
+	compressed, err := newPermessageDeflate(CompressionOptions{}).instance(true).compress([]byte("hello"), true)
+	require.Nil(t, err)
+	first := constructFrame(OpCodeText, false, true)
+	first.RSV1 = 1
+	first.setPayload(compressed)
+	next := constructFrame(OpCodeContinuation, true, true)
+	next.RSV1 = 1
+	next.setPayload(nil)
+	require.Nil(t, conn.sendFrame(first))
+	require.Nil(t, conn.sendFrame(next))
+
+	_, r, err := conn.NextReader()
+	require.Nil(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+}
+
+func Test_Conn_Compression_interrupted(t *testing.T) {
+	// the compressed message could not be resumed after timeout, the Conn is
+	// closed rather than stuck with the broken message.
+	part := []byte(strings.Repeat("interrupted ", 10000))
+	timedOut := make(chan struct{})
+	srv, wsURL := newTestServer(Upgrader{EnableCompression: true}, func(conn *Conn) {
+		w, err := conn.NextWriter(TextMessage)
+		if err != nil {
+			return
+		}
+		_, _ = w.Write(part)
+		<-timedOut
+		_, _ = w.Write(part)
+		_ = w.Close()
+		_ = conn.SendMessage("next")
+		_, _, _ = conn.ReadMessage()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL, WithCompression(CompressionOptions{}))
+	require.Nil(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err = conn.ReadMessageContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	close(timedOut)
+
+	_, _, err = conn.ReadMessage()
+	assert.Equal(t, ErrMessageInterrupted, err)
+	assert.Equal(t, Closed, conn.State())
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrMessageInterrupted, err)
+}
@@ -15,21 +15,48 @@ package websocket
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 var (
 	ErrMaskNotSet = errors.New("mask is not set")
 	ErrMaskSet    = errors.New("mask is set")
+	// ErrNotConnected .
+	ErrNotConnected = errors.New("websocket: could not send if state not Connected")
 )
 
 const (
-	_FragmentLimit = 65535 // the size to fragment frame
+	_FragmentLimit = 65535 // the default size of read buffer
+
+	// defaultWriteBufferSize is the default size of write buffer, it's the
+	// same as bufio.NewWriter.
+	defaultWriteBufferSize = 4096
+	// minReadBufferSize makes sure the header of frame along with the payload
+	// of control frame could be peeked from read buffer.
+	minReadBufferSize = 256
+
+	// DefaultWriteFragmentSize is the default max payload size of each frame
+	// while sending a message.
+	DefaultWriteFragmentSize = 65535
+	// NoFragmentation could be set as write fragment size, so that messages
+	// are always sent in one frame.
+	NoFragmentation = -1
+
+	// defaultCloseTimeout of waiting for close frame from peer
+	defaultCloseTimeout = 5 * time.Second
+	// defaultMaxBufferedFrameSize bounds the payload of data frame which is
+	// buffered in whole, e.g. to be decoded by extensions, if neither read
+	// limit nor max frame size is set.
+	defaultMaxBufferedFrameSize = 64 << 20
 )
 
 // ConnState denotes the underlying connection's state.
@@ -53,30 +80,71 @@ const (
 	// NoFrame .
 	NoFrame MessageType = 0
 	// TextMessage .
-	TextMessage = MessageType(opCodeText)
+	TextMessage = MessageType(OpCodeText)
 	// BinaryMessage .
-	BinaryMessage = MessageType(opCodeBinary)
+	BinaryMessage = MessageType(OpCodeBinary)
 	// CloseMessage .
-	CloseMessage = MessageType(opCodeClose)
+	CloseMessage = MessageType(OpCodeClose)
 	// PingMessage .
-	PingMessage = MessageType(opCodePing)
+	PingMessage = MessageType(OpCodePing)
 	// PongMessage .
-	PongMessage = MessageType(opCodePong)
+	PongMessage = MessageType(OpCodePong)
 )
 
-// Conn .
+// Conn . it's safe to call write methods [SendMessage, SendBinary, WriteMessage,
+// NextWriter, Ping, Close] concurrently, data messages are written one by one as
+// a whole, and control frames could be sent between fragments of data message.
+// Read methods [ReadMessage, NextReader] should be called by one goroutine.
 type Conn struct {
+	// lastActiveNano is the last time in unix nanoseconds when something has
+	// been received from peer, it's accessed atomically, so it's kept first
+	// for 64-bit alignment.
+	lastActiveNano int64
+
 	// conn is underlying TCP connection to send and receive byte stream.
 	// on client side it's opened by net.Dial(protocol, addr)
 	// on server side it can be got by (http.ResponseWriter).(http.Hijacker).Hijack()
 	conn net.Conn
 
 	bufRD *bufio.Reader
-	bufWR *bufio.Writer
+	// bufWR is nil if writePool is set, the write buffer is borrowed from
+	// writePool while a frame is being written.
+	bufWR           *bufio.Writer
+	writePool       BufferPool
+	writeBufferSize int
 
-	// State marks Conn current state, and it is basis of controlling the Conn.
+	// state marks Conn current state, and it is basis of controlling the Conn.
 	// unnecessary: maybe import an state machine to manage with
-	State ConnState
+	state   ConnState
+	stateMu sync.RWMutex
+	// done is closed once state becomes Closed.
+	done     chan struct{}
+	doneOnce sync.Once
+	// readErr is reported by read methods instead of the error of underlying
+	// connection, if Conn has been closed locally for the reason.
+	readErr error
+	// closeRecv is closed once close frame from peer has been received, and
+	// closeStatus is the code and reason of it.
+	closeRecv   chan struct{}
+	closeStatus *CloseError
+	// closeTimeout bounds waiting for close frame from peer in CloseWithCode.
+	closeTimeout time.Duration
+
+	// msgSem serializes data messages, it's held from the first frame to the
+	// final frame of a message. Semaphores are used rather than sync.Mutex,
+	// so that waiting could be aborted by context.
+	msgSem chan struct{}
+	// writeSem serializes frames written into bufWR, control frames only hold
+	// writeSem, so that they could be sent between fragments.
+	writeSem chan struct{}
+	// readSem is held by read methods, CloseWithCode reads close frame from
+	// peer by itself only if it's not held.
+	readSem chan struct{}
+
+	// deadlines set by user, they are restored after context interrupts I/O.
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
 
 	// isServer, true means Conn is working on server side
 	// false means Conn is working on client side
@@ -87,43 +155,162 @@ type Conn struct {
 
 	// pongHandler work for client-side or server-side notify.
 	pongHandler func(payload string)
+	// pingHandler replaces replying pong if it's not nil.
+	pingHandler func(appData string) error
+	// closeHandler is called before replying close frame if it's not nil.
+	closeHandler func(code int, text string) error
+
+	// extensions are negotiated while handshake, and work on data frames
+	// in the same order.
+	extensions []Extension
+
+	// subprotocol is negotiated by Sec-WebSocket-Protocol while handshake.
+	subprotocol string
+
+	// readLimit is the max size of message, and maxFrameSize is the max size
+	// of frame payload, 0 means no limit.
+	readLimit    int64
+	maxFrameSize int64
+
+	// writeFragmentSize is the max payload size of frames of outgoing
+	// messages, see SetWriteFragmentSize.
+	writeFragmentSize int
+
+	// skipUTF8Validation skips validating text messages and close reasons
+	// from peer, it's for trusted peers.
+	skipUTF8Validation bool
+
+	// reader is the reader of current message returned by NextReader.
+	reader *messageReader
+	// partial is the message read by ReadMessage before it's interrupted,
+	// the next ReadMessage would resume it.
+	partial     *bytes.Buffer
+	partialType MessageType
+}
+
+// BufferPool represents a pool of buffers, *sync.Pool satisfies it. The type
+// of values stored in the pool is not specified, they are managed by Conn.
+type BufferPool interface {
+	// Get gets a value from the pool or returns nil if the pool is empty.
+	Get() interface{}
+	// Put adds a value to the pool.
+	Put(interface{})
+}
+
+// bufferOptions configures the read and write buffers of Conn.
+type bufferOptions struct {
+	// readBufferSize and writeBufferSize are the size of buffers, 0 means
+	// the default size.
+	readBufferSize  int
+	writeBufferSize int
+	// writePool lends write buffers only while frames are being written, so
+	// that idle Conn holds no write buffer.
+	writePool BufferPool
+
+	// br and bw are reused if they are large enough, e.g. the buffers returned
+	// by http.Hijacker. Buffered data of br is never dropped.
+	br *bufio.Reader
+	bw *bufio.Writer
 }
 
 // newConn build an websocket.Conn to handle with websocket.Frame
 // there is some different between server side and client.
-func newConn(netconn net.Conn, isServer bool) (*Conn, error) {
+func newConn(netconn net.Conn, isServer bool, bufOpts bufferOptions) (*Conn, error) {
+	readBufferSize := bufOpts.readBufferSize
+	if readBufferSize == 0 {
+		readBufferSize = _FragmentLimit
+	}
+	if readBufferSize < minReadBufferSize {
+		readBufferSize = minReadBufferSize
+	}
+	writeBufferSize := bufOpts.writeBufferSize
+	if writeBufferSize <= 0 {
+		writeBufferSize = defaultWriteBufferSize
+	}
+
 	c := Conn{
-		conn: netconn,
-		// bufio.NewReader(netconn) with default buffer size=4096B Byte = 4KB,
-		// but here specifies _FragmentLimit Bytes = 64KB.
-		bufRD: bufio.NewReaderSize(netconn, _FragmentLimit),
-		// bufio.NewReader(netconn) with default buffer size=4096B Byte = 4KB
-		bufWR:    bufio.NewWriter(netconn),
-		State:    Connecting,
-		isServer: isServer,
+		conn:            netconn,
+		writePool:       bufOpts.writePool,
+		writeBufferSize: writeBufferSize,
+		state:           Connecting,
+		done:            make(chan struct{}),
+		closeRecv:       make(chan struct{}),
+		closeTimeout:    defaultCloseTimeout,
+		msgSem:          make(chan struct{}, 1),
+		writeSem:        make(chan struct{}, 1),
+		readSem:         make(chan struct{}, 1),
+		isServer:        isServer,
+	}
+
+	switch br := bufOpts.br; {
+	case br != nil && br.Size() >= readBufferSize:
+		c.bufRD = br
+	case br != nil && br.Buffered() != 0:
+		// read through br, so that data buffered in it is not lost.
+		c.bufRD = bufio.NewReaderSize(br, readBufferSize)
+	default:
+		c.bufRD = bufio.NewReaderSize(netconn, readBufferSize)
+	}
+
+	if c.writePool == nil {
+		if bw := bufOpts.bw; bw != nil && bw.Size() >= writeBufferSize {
+			c.bufWR = bw
+		} else {
+			c.bufWR = bufio.NewWriterSize(netconn, writeBufferSize)
+		}
 	}
 
 	return &c, nil
 }
 
-// read n bytes from conn read buffer
-// inspired by gorilla/websocket
-func (c *Conn) read(n int) (p []byte, err error) {
-	//p = make([]byte, n)
-	//actual := 0
-	//actual, err = c.bufRD.Read(p)
-	//if err == io.EOF {
-	//	err = ErrUnexpectedEOF
-	//	return nil, err
-	//}
-	//return p[:actual], err
+// getWriter returns the write buffer, it's borrowed from writePool if it's set,
+// and must be returned by putWriter.
+func (c *Conn) getWriter() *bufio.Writer {
+	if c.writePool == nil {
+		return c.bufWR
+	}
+
+	if w, ok := c.writePool.Get().(*bufio.Writer); ok && w.Size() >= c.writeBufferSize {
+		w.Reset(c.conn)
+		return w
+	}
+	return bufio.NewWriterSize(c.conn, c.writeBufferSize)
+}
+
+// putWriter returns w to writePool if it's borrowed.
+func (c *Conn) putWriter(w *bufio.Writer) {
+	if c.writePool == nil {
+		return
+	}
+
+	// the pool should not keep the Conn alive
+	w.Reset(nil)
+	c.writePool.Put(w)
+}
+
+// peek n bytes from conn read buffer without consuming them, so that nothing
+// is lost if it's interrupted by deadline.
+func (c *Conn) peek(n int) (p []byte, err error) {
 	p, err = c.bufRD.Peek(n)
-	if err == io.EOF {
-		err = ErrUnexpectedEOF
-		return nil, err
+	if err != nil {
+		if err == io.EOF {
+			err = ErrUnexpectedEOF
+		}
+		return p, c.readError(err)
+	}
+	c.touch()
+	return p, nil
+}
+
+// readError returns the reason if Conn has been closed locally, e.g.
+// ErrKeepaliveTimeout, otherwise err of reading is returned.
+func (c *Conn) readError(err error) error {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	if c.readErr != nil {
+		return c.readErr
 	}
-	_, _ = c.bufRD.Discard(len(p))
-	return p, err
+	return err
 }
 
 func (c *Conn) readFrame() (*Frame, error) {
@@ -131,140 +318,223 @@ func (c *Conn) readFrame() (*Frame, error) {
 	// 	return nil, errors.New("websocket: could not send if state not Connected")
 	// }
 
-	p, err := c.read(2)
-	// this would be blocked, if no data comes
+	frm, remaining, err := c.readFrameHeader()
 	if err != nil {
-		debugErrorf("Conn.readFrame failed to c.read(header), err=%v", err)
 		return nil, err
 	}
 
+	if err = c.readFramePayload(frm, remaining); err != nil {
+		return nil, err
+	}
+
+	// handle with close, ping, pong frame
+	err = c.handleControlFrame(frm)
+	return frm, err
+}
+
+// readFrameHeader read frame header without payload, and validate it. remaining
+// is the length of payload which has not been read. The header is consumed only
+// if it has been read completely, as well as the payload of control frame, so
+// that reading could be resumed after timeout.
+func (c *Conn) readFrameHeader() (frmWithoutPayload *Frame, remaining uint64, err error) {
+	p, err := c.peek(2)
+	// this would be blocked, if no data comes
+	if err != nil {
+		debugErrorf("Conn.readFrame failed to c.peek(header), err=%v", err)
+		return nil, 0, err
+	}
+
 	// parse frame header
-	frmWithoutPayload := parseFrameHeader(p)
+	frmWithoutPayload = parseFrameHeader(p)
 	//logger.Debugf("Conn.readFrame got frmWithoutPayload=%+v", frmWithoutPayload)
 
-	var (
-		payloadExtendLen uint64 // this could be non exist
-		remaining        uint64
-	)
-
-	switch frmWithoutPayload.PayloadLen {
-	case 126:
-		// has 16bit + 32bit = 6B
-		p, err = c.read(2)
-		if err != nil {
-			debugErrorf("Conn.readFrame failed to c.read(2) payload's len with 16bit, err=%v", err)
-			return nil, err
-		}
-		payloadExtendLen = uint64(binary.BigEndian.Uint16(p[:2]))
-		remaining = payloadExtendLen
-	case 127:
-		// has 64bit + 32bit = 12B
-		p, err = c.read(8)
-		if err != nil {
-			debugErrorf("Conn.readFrame failed to c.read(8) payload's len with 16bit, err=%v", err)
-			return nil, err
-		}
-		payloadExtendLen = binary.BigEndian.Uint64(p[:8])
-		remaining = payloadExtendLen
-	default:
-		remaining = uint64(frmWithoutPayload.PayloadLen)
+	headerLen := frameHeaderLen(frmWithoutPayload)
+	peekLen := headerLen
+	if frmWithoutPayload.OpCode >= OpCodeClose && frmWithoutPayload.PayloadLen <= 125 {
+		// payload of control frame is small, read it along with header
+		peekLen += int(frmWithoutPayload.PayloadLen)
 	}
-	frmWithoutPayload.PayloadExtendLen = payloadExtendLen
 
-	if frmWithoutPayload.Mask == 1 {
-		// if frame has a MaskingKey, so there are 32 bits to read.
-		p, err = c.read(4)
-		if err != nil {
-			debugErrorf("Conn.readFrame failed to c.read(mask), err=%v", err)
-			return nil, err
-		}
-		frmWithoutPayload.MaskingKey = binary.BigEndian.Uint32(p)
+	if p, err = c.peek(peekLen); err != nil {
+		debugErrorf("Conn.readFrame failed to c.peek(%d) header, err=%v", peekLen, err)
+		return nil, 0, err
 	}
 
+	remaining = parseFrameHeaderExt(frmWithoutPayload, p)
+	_, _ = c.bufRD.Discard(headerLen)
+
 	// valid in common rules
-	if err = frmWithoutPayload.valid(); err != nil {
+	if err = frmWithoutPayload.valid(c.rsvBits()); err != nil {
 		debugErrorf("Conn.readFrame is not valid(frm.valid) in common rules, err=%v", err)
 		_ = c.close(CloseProtocolError)
-		return nil, err
+		return nil, 0, err
 	}
 
 	// valid in Conn rules
 	if err = c.validFrame(frmWithoutPayload); err != nil {
 		debugErrorf("Conn.readFrame is not valid(conn.validFrame) for Conn rules, err=%v", err)
-		return nil, err
+		_ = c.close(CloseProtocolError)
+		return nil, 0, err
 	}
 
-	// FIXED: big remaining(uint64) cast loss precision
-	var (
-		payload = make([]byte, 0, remaining)
-	)
+	if c.maxFrameSize > 0 && remaining > uint64(c.maxFrameSize) {
+		debugErrorf("Conn.readFrame got frame with payload=%d over limit=%d", remaining, c.maxFrameSize)
+		_ = c.close(CloseMessageTooBig)
+		return nil, 0, ErrReadLimit
+	}
 
-	//logger.Debugf("Conn.readFrame c.read(%d) into payload data", remaining)
-	for remaining > _FragmentLimit {
-		// true: bufio.Reader can read _FragmentLimit bytes data at most once,
-		// since read bufSize = _FragmentLimit
-		// p = make([]byte, 0, _FragmentLimit)
-		p, err = c.read(_FragmentLimit)
-		if err != nil {
-			debugErrorf("Conn.readFrame failed to c.read(payload), err=%v", err)
-			return nil, err
-		}
-		payload = append(payload, p...)
-		remaining -= _FragmentLimit
+	return frmWithoutPayload, remaining, nil
+}
+
+// readFramePayload read remaining payload into frame, then unmask and decode it.
+func (c *Conn) readFramePayload(frmWithoutPayload *Frame, remaining uint64) (err error) {
+	if err = c.readRawFramePayload(frmWithoutPayload, remaining); err != nil {
+		return err
 	}
 
-	// less part to read
-	p, err = c.read(int(remaining))
+	return c.decodeReadFrame(frmWithoutPayload)
+}
+
+// readRawFramePayload read remaining payload into frame and unmask it, the
+// payload is not decoded by extensions.
+func (c *Conn) readRawFramePayload(frmWithoutPayload *Frame, remaining uint64) (err error) {
+	buf, err := c.newFrameBuffer(frmWithoutPayload, remaining)
 	if err != nil {
-		debugErrorf("Conn.readFrame failed to c.read(payload), err=%v", err)
-		return nil, err
+		return err
 	}
-	payload = append(payload, p...)
-	// logger.Debugf("Conn.readFrame got payload=%s then set into frmWithoutPayload", payload)
-	frmWithoutPayload.setPayload(payload)
 
-	// handle with close, ping, pong frame
-	switch frmWithoutPayload.OpCode {
-	case opCodeText, opCodeBinary, opCodeContinuation:
+	// the buffer grows as payload comes, the length from peer is never
+	// trusted to allocate.
+	if _, err = io.CopyN(buf, connReader{c}, int64(remaining)); err != nil {
+		if err == io.EOF {
+			err = ErrUnexpectedEOF
+		}
+		err = c.readError(err)
+		debugErrorf("Conn.readFrame failed to read payload, err=%v", err)
+		return err
+	}
+	frmWithoutPayload.setPayload(buf.Bytes())
+
+	return nil
+}
+
+// newFrameBuffer creates the buffer to collect the whole payload of frm, the
+// payload of data frame is bounded by max frame size or read limit, and
+// defaultMaxBufferedFrameSize if neither of them is set. The Conn is closed
+// with CloseMessageTooBig if it's over the limit.
+func (c *Conn) newFrameBuffer(frm *Frame, remaining uint64) (*bytes.Buffer, error) {
+	if frm.OpCode < OpCodeClose {
+		limit := uint64(defaultMaxBufferedFrameSize)
+		switch {
+		case c.maxFrameSize > 0:
+			limit = uint64(c.maxFrameSize)
+		case c.readLimit > 0:
+			limit = uint64(c.readLimit)
+		}
+		if remaining > limit {
+			debugErrorf("Conn.newFrameBuffer got frame with payload=%d over limit=%d", remaining, limit)
+			_ = c.close(CloseMessageTooBig)
+			return nil, ErrReadLimit
+		}
+	}
+
+	size := uint64(c.bufRD.Size())
+	if remaining < size {
+		size = remaining
+	}
+	return bytes.NewBuffer(make([]byte, 0, size)), nil
+}
+
+// connReader reads payload from the read buffer of Conn.
+type connReader struct {
+	c *Conn
+}
+
+func (r connReader) Read(p []byte) (int, error) {
+	n, err := r.c.bufRD.Read(p)
+	if n != 0 {
+		r.c.touch()
+	}
+	return n, err
+}
+
+// decodeReadFrame decodes frame by extensions after payload has been read,
+// Conn is closed if it fails.
+func (c *Conn) decodeReadFrame(frm *Frame) error {
+	if err := c.decodeDataFrame(frm); err != nil {
+		debugErrorf("Conn.readFrame failed to c.decodeDataFrame, err=%v", err)
+		closeCode := CloseProtocolError
+		if closeErr, ok := err.(*CloseError); ok {
+			closeCode = closeErr.Code
+		}
+		_ = c.close(closeCode)
+		return err
+	}
+
+	return nil
+}
+
+// handleControlFrame handle with close, ping, pong frame.
+func (c *Conn) handleControlFrame(frm *Frame) (err error) {
+	switch frm.OpCode {
+	case OpCodeText, OpCodeBinary, OpCodeContinuation:
 		// DONE: support fragment
 		// DONE: support binary data format
-	case opCodePing:
-		err = c.replyPing(frmWithoutPayload)
-	case opCodePong:
-		err = c.replyPong(frmWithoutPayload)
-	case opCodeClose:
-		err = c.handleClose(frmWithoutPayload)
+	case OpCodePing:
+		err = c.replyPing(frm)
+	case OpCodePong:
+		err = c.replyPong(frm)
+	case OpCodeClose:
+		err = c.handleClose(frm)
 	}
 
-	return frmWithoutPayload, err
+	return err
 }
 
 // sendDataFrame send data frame [text, binary]
 // DONE(@yeqown): limit send payload size, into 65535 [maybe auto fragment the payload]
 func (c *Conn) sendDataFrame(data []byte, opcode OpCode) (err error) {
+	return c.sendDataFrameContext(context.Background(), data, opcode)
+}
+
+// sendDataFrameContext send data frame [text, binary], it's aborted once ctx
+// is done. The Conn is closed if the message has been sent partially.
+func (c *Conn) sendDataFrameContext(ctx context.Context, data []byte, opcode OpCode) (err error) {
 	switch opcode {
-	case opCodeText, opCodeBinary:
+	case OpCodeText, OpCodeBinary:
 	default:
 		return fmt.Errorf("invalid opcode=%d for data frame", opcode)
 	}
 
-	// need fragment
-	if len(data) > 65535 {
-		frames := fragmentDataFrames(data, c.isServer, opcode)
-		for _, frm := range frames {
-			if err = c.sendFrame(frm); err != nil {
-				debugErrorf("c.send failed to c.sendFrame err=%v", err)
-				return
-			}
-		}
+	// hold msgSem until the whole message has been sent
+	if err = acquire(ctx, c.msgSem); err != nil {
+		return err
+	}
+	defer release(c.msgSem)
 
-		return
+	// need fragment
+	// frames are constructed without mask, since extensions should encode
+	// frames before masking.
+	var frames []*Frame
+	if size := c.fragmentSize(); size > 0 && len(data) > size {
+		frames = fragmentDataFrames(data, size, true, opcode)
+	} else {
+		frames = []*Frame{constructDataFrame(data, true, opcode)}
 	}
 
-	frm := constructDataFrame(data, c.isServer, opcode)
-	if err = c.sendFrame(frm); err != nil {
-		debugErrorf("c.send failed to c.sendFrame err=%v", err)
-		return
+	for i, frm := range frames {
+		if err = c.encodeDataFrame(frm); err != nil {
+			debugErrorf("c.send failed to c.encodeDataFrame err=%v", err)
+			return
+		}
+		if err = c.sendFrameContext(ctx, frm); err != nil {
+			debugErrorf("c.send failed to c.sendFrame err=%v", err)
+			if i != 0 {
+				// the message could not be finished
+				c.abort()
+			}
+			return
+		}
 	}
 
 	return
@@ -273,9 +543,14 @@ func (c *Conn) sendDataFrame(data []byte, opcode OpCode) (err error) {
 // sendControlFrame .
 // send control frame [ping, pong, close, continuation]
 func (c *Conn) sendControlFrame(opcode OpCode, payload []byte) (err error) {
-	frm := constructControlFrame(opcode, c.isServer, payload)
-	frm.setPayload(payload)
-	if err = c.sendFrame(frm); err != nil {
+	return c.sendControlFrameContext(context.Background(), opcode, payload)
+}
+
+// sendControlFrameContext send control frame, it's aborted once ctx is done.
+func (c *Conn) sendControlFrameContext(ctx context.Context, opcode OpCode, payload []byte) (err error) {
+	frm := constructControlFrame(opcode, true, payload)
+	c.maskFrame(frm)
+	if err = c.sendFrameContext(ctx, frm); err != nil {
 		debugErrorf("c.send failed to c.sendFrame err=%v", err)
 		return
 	}
@@ -286,67 +561,232 @@ func (c *Conn) sendControlFrame(opcode OpCode, payload []byte) (err error) {
 // sendFrame .
 // FIXED could not send while Conn.State is not "connected"
 func (c *Conn) sendFrame(frm *Frame) (err error) {
-	if !c.Connected() {
-		return errors.New("websocket: could not send if state not Connected")
+	return c.sendFrameContext(context.Background(), frm)
+}
+
+// sendFrameContext send frame, it's aborted once ctx is done. If ctx is done
+// while writing, the Conn is closed since the frame may be written partially.
+func (c *Conn) sendFrameContext(ctx context.Context, frm *Frame) (err error) {
+	if err = acquire(ctx, c.writeSem); err != nil {
+		return err
+	}
+	defer release(c.writeSem)
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	// close frame is sent while Closing
+	state := c.State()
+	if state != Connected && !(state == Closing && frm.OpCode == OpCodeClose) {
+		return ErrNotConnected
 	}
 
 	// logger.Debugf("Conn.sendFrame with frame=%+v", frm)
 	debugPrintFrame(frm)
 	data := encodeFrameTo(frm)
-	_, err = c.bufWR.Write(data)
+	stop := c.watchContext(ctx, false)
+	w := c.getWriter()
+	if _, err = w.Write(data); err == nil {
+		err = w.Flush()
+	}
+	c.putWriter(w)
+	interrupted := stop()
 	if err != nil {
-		debugErrorf("c.sendFrame failed to c.bufWR.Write, err=%v", err)
+		debugErrorf("c.sendFrame failed to write frame, err=%v", err)
+		// frame may be written partially, so that the Conn is broken.
+		c.abort()
+		if interrupted {
+			err = ctx.Err()
+		}
 		return err
 	}
-	err = c.bufWR.Flush()
-	return err
+
+	return nil
+}
+
+// abort closes underlying connection without (or after) closing handshake,
+// it's used while framing is broken, e.g. frame or message is sent partially.
+// State is updated to 'Closed' before closing underlying TCP connection, so
+// that State is Closed once reading fails.
+func (c *Conn) abort() {
+	c.setState(Closed)
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
 }
 
-// ReadMessage . it will block to read message
+// ReadMessage . it will block to read message, the whole message would be
+// read into memory, use NextReader to read large message. If reading fails
+// with timeout, the message read partially is kept, and the next ReadMessage
+// would resume it, except compressed message, see NextReader.
 func (c *Conn) ReadMessage() (mt MessageType, msg []byte, err error) {
-	frm, err := c.readFrame()
-	if err != nil {
-		debugErrorf("Conn.ReadMessage failed to c.readFrame, err=%v", err)
-		return NoFrame, nil, err
+	_ = acquire(context.Background(), c.readSem)
+	defer release(c.readSem)
+
+	if c.partial == nil {
+		mt, _, err := c.nextReader()
+		if err != nil {
+			debugErrorf("Conn.ReadMessage failed to c.NextReader, err=%v", err)
+			return NoFrame, nil, err
+		}
+		c.partial, c.partialType = bytes.NewBuffer(nil), mt
 	}
-	mt = MessageType(frm.OpCode)
 
 	// read fragment of frame
-	buf := bytes.NewBuffer(nil)
-	buf.Write(frm.Payload)
-	for !frm.isFinal() {
-		if frm, err = c.readFrame(); err != nil {
-			debugErrorf("Conn.ReadMessage failed to c.readFrame, err=%v", err)
-			return NoFrame, nil, err
+	if _, err = c.partial.ReadFrom(unlockedReader{c.reader}); err != nil {
+		debugErrorf("Conn.ReadMessage failed to read message, err=%v", err)
+		if !isTimeout(err) {
+			c.partial, c.reader = nil, nil
 		}
-		buf.Write(frm.Payload)
+		return NoFrame, nil, err
 	}
 
-	msg = buf.Bytes()
+	mt, msg = c.partialType, c.partial.Bytes()
+	c.partial = nil
 	return
 }
 
+// ReadMessageContext . same as ReadMessage, but it's aborted with ctx.Err()
+// once ctx is done. Framing is not broken by abort, the message read partially
+// would be resumed by the next ReadMessage or ReadMessageContext.
+func (c *Conn) ReadMessageContext(ctx context.Context) (mt MessageType, msg []byte, err error) {
+	if err = ctx.Err(); err != nil {
+		return NoFrame, nil, err
+	}
+
+	stop := c.watchContext(ctx, true)
+	mt, msg, err = c.ReadMessage()
+	if interrupted := stop(); interrupted && err != nil {
+		err = ctx.Err()
+	}
+	return mt, msg, err
+}
+
+// NextReader . it will block until a data message [text, binary] comes, control
+// frames before it are handled. The returned io.Reader yields the payload across
+// continuation frames, and control frames between them are handled as well, it's
+// valid until NextReader is called again, the unread part of message would be
+// discarded then.
+//
+// If permessage-deflate is the only negotiated extension, compressed message is
+// decompressed on the fly, but it could not be resumed after timeout in the
+// middle, the Conn is closed and ErrMessageInterrupted is returned then. If
+// other extensions are negotiated along with it, frames are decoded one by one,
+// and the whole compressed message is buffered until its final frame comes.
+func (c *Conn) NextReader() (MessageType, io.Reader, error) {
+	_ = acquire(context.Background(), c.readSem)
+	defer release(c.readSem)
+
+	return c.nextReader()
+}
+
+// nextReader is NextReader without taking readSem.
+func (c *Conn) nextReader() (MessageType, io.Reader, error) {
+	c.partial = nil
+	if c.reader != nil {
+		// discard the unread part of previous message
+		if _, err := io.Copy(ioutil.Discard, unlockedReader{c.reader}); err != nil {
+			debugErrorf("Conn.NextReader failed to discard previous message, err=%v", err)
+			if !isTimeout(err) {
+				// the error is sticky, it's returned only once
+				c.reader = nil
+			}
+			return NoFrame, nil, err
+		}
+		c.reader = nil
+	}
+
+	for {
+		frm, remaining, err := c.readFrameHeader()
+		if err != nil {
+			debugErrorf("Conn.NextReader failed to c.readFrameHeader, err=%v", err)
+			return NoFrame, nil, err
+		}
+
+		switch frm.OpCode {
+		case OpCodeText, OpCodeBinary:
+			r, err := newMessageReader(c, frm, remaining)
+			if err != nil {
+				return NoFrame, nil, err
+			}
+			c.reader = r
+			return MessageType(frm.OpCode), r, nil
+		case OpCodeContinuation:
+			err = ErrUnexpectedContinuation
+			_ = c.close(CloseProtocolError)
+			return NoFrame, nil, err
+		}
+
+		// control frames
+		if err = c.readFramePayload(frm, remaining); err != nil {
+			return NoFrame, nil, err
+		}
+		if err = c.handleControlFrame(frm); err != nil {
+			return NoFrame, nil, err
+		}
+	}
+}
+
 // SendMessage . sending text data to other side
 func (c *Conn) SendMessage(text string) (err error) {
-	return c.sendDataFrame([]byte(text), opCodeText)
+	return c.sendDataFrame([]byte(text), OpCodeText)
 }
 
-// SendBinary . sending bianry data to other-side
+// SendBinary . sending bianry data to other-side, r is read part by part,
+// so that large data could be sent without loading it into memory.
+//
+// If reading r fails, the message is aborted and the error is returned, the
+// Conn is closed if a part of message has been sent, see messageWriter.abort.
 func (c *Conn) SendBinary(r io.Reader) (err error) {
-	payload, err := ioutil.ReadAll(r)
-	if err != nil {
-		debugErrorf("c.SendBinary failed to ioutil.ReadAll, err=%v", err)
+	_ = acquire(context.Background(), c.msgSem)
+	w := newMessageWriter(c, OpCodeBinary)
+
+	if _, err = io.Copy(w, r); err != nil {
+		debugErrorf("c.SendBinary failed to io.Copy, err=%v", err)
+		w.abort()
 		return err
 	}
 
-	return c.sendDataFrame(payload, opCodeBinary)
+	return w.Close()
+}
+
+// NextWriter . returns a writer to send a data message [text, binary], payload
+// is sent as continuation frames once the buffer is full, and the final frame
+// is sent by Close. It blocks until the previous message has been finished,
+// so the writer MUST be closed, even if Write fails.
+func (c *Conn) NextWriter(mt MessageType) (io.WriteCloser, error) {
+	switch mt {
+	case TextMessage, BinaryMessage:
+	default:
+		return nil, fmt.Errorf("invalid message type=%d for NextWriter", mt)
+	}
+
+	// msgSem would be released by messageWriter.Close
+	_ = acquire(context.Background(), c.msgSem)
+	return newMessageWriter(c, OpCode(mt)), nil
+}
+
+// WriteMessage . sends a data message [text, binary] as a whole.
+func (c *Conn) WriteMessage(mt MessageType, data []byte) error {
+	return c.WriteMessageContext(context.Background(), mt, data)
+}
+
+// WriteMessageContext . same as WriteMessage, but it's aborted with ctx.Err()
+// once ctx is done. If the message has been sent partially, the Conn would be
+// closed, since the peer could never get a complete message.
+func (c *Conn) WriteMessageContext(ctx context.Context, mt MessageType, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.sendDataFrameContext(ctx, data, OpCode(mt))
 }
 
 // handle close frame
 // to READ close code and text info
 func (c *Conn) handleClose(frm *Frame) error {
 	var err = &CloseError{
-		Code: CloseNormalClosure,
+		Code: CloseNoStatusReceived,
 	}
 
 	if frm.PayloadLen >= 2 {
@@ -357,24 +797,106 @@ func (c *Conn) handleClose(frm *Frame) error {
 	}
 	logger.Debugf("c.handleClose got a frame with closeError=%v", err)
 
-	c.close(err.Code)
+	if frm.PayloadLen == 1 || (frm.PayloadLen >= 2 && !isValidCloseCode(err.Code)) {
+		_ = c.close(CloseProtocolError)
+		return ErrInvalidClosePayload
+	}
+
+	if !c.skipUTF8Validation && !utf8.ValidString(err.Text) {
+		_ = c.close(CloseInvalidFramePayloadData)
+		return ErrInvalidUTF8
+	}
+
+	// notify CloseWithCode which is waiting for it
+	c.stateMu.Lock()
+	if c.closeStatus == nil {
+		c.closeStatus = err
+		close(c.closeRecv)
+	}
+	c.stateMu.Unlock()
+
+	var herr error
+	if c.closeHandler != nil {
+		herr = c.closeHandler(err.Code, err.Text)
+	}
+
+	// echo the code if peer starts closing handshake, and peer has sent close
+	// frame, so there is nothing to wait for.
+	if c.casState(Connected, Closing) {
+		if serr := c.sendControlFrame(OpCodeClose, closePayload(err.Code, "")); serr != nil {
+			debugErrorf("c.handleClose failed to c.sendControlFrame, err=%v", serr)
+		}
+	}
+	c.abort()
+	if herr != nil {
+		return herr
+	}
 	return err
 }
 
+// EnableWriteCompression enables or disables compression of outgoing messages,
+// it takes effect only if permessage-deflate has been negotiated. It waits for
+// the message being sent, and works on the next message.
+func (c *Conn) EnableWriteCompression(enable bool) {
+	_ = acquire(context.Background(), c.msgSem)
+	defer release(c.msgSem)
+
+	for _, ext := range c.extensions {
+		if pmd, ok := ext.(*permessageDeflate); ok {
+			pmd.writeCompression = enable
+		}
+	}
+}
+
+// Subprotocol returns the negotiated subprotocol, "" means none.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Extensions returns the names of negotiated extensions.
+func (c *Conn) Extensions() []string {
+	names := make([]string, 0, len(c.extensions))
+	for _, ext := range c.extensions {
+		names = append(names, ext.Name())
+	}
+	return names
+}
+
 // Ping conn send a ping packet to another side.
 func (c *Conn) Ping() (err error) {
-	return c.sendControlFrame(opCodePing, []byte("ping"))
+	return c.PingContext(context.Background())
+}
+
+// PingContext . same as Ping, but it's aborted with ctx.Err() once ctx is done.
+func (c *Conn) PingContext(ctx context.Context) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return c.sendControlFrameContext(ctx, OpCodePing, []byte("ping"))
 }
 
 // replyPing work for Conn to reply ping packet. frame MUST contains 125 Byte or-
 // less payload.
 func (c *Conn) replyPing(frm *Frame) (err error) {
+	if c.pingHandler != nil {
+		return c.pingHandler(string(frm.Payload))
+	}
+	if c.State() != Connected {
+		// nothing could be sent after close frame
+		return nil
+	}
 	return c.pong(frm.Payload)
 }
 
+// Pong conn send a pong packet with appData to another side, it could be used
+// by ping handler to reply, or as an unidirectional heartbeat.
+func (c *Conn) Pong(appData string) (err error) {
+	return c.pong([]byte(appData))
+}
+
 // pong .
 func (c *Conn) pong(pingPayload []byte) (err error) {
-	return c.sendControlFrame(opCodePong, pingPayload)
+	return c.sendControlFrame(OpCodePong, pingPayload)
 }
 
 // replyPong frame MUST contains same payload with PING frame payload
@@ -387,51 +909,361 @@ func (c *Conn) replyPong(frm *Frame) (err error) {
 	return nil
 }
 
+// SetReadLimit sets the max size in bytes of message from peer, it works on
+// the decoded payload across continuation frames. If a message is over limit,
+// the Conn is closed with CloseMessageTooBig, and read methods would return
+// ErrReadLimit. n <= 0 means no limit, but a frame which has to be buffered in
+// whole, e.g. to be decoded by extensions, is still bounded by 64MB.
+func (c *Conn) SetReadLimit(n int64) {
+	c.readLimit = n
+}
+
+// SetCloseTimeout sets the max duration of waiting for close frame from peer
+// in Close and CloseWithCode, d <= 0 means the default 5s.
+func (c *Conn) SetCloseTimeout(d time.Duration) {
+	if d <= 0 {
+		d = defaultCloseTimeout
+	}
+	c.closeTimeout = d
+}
+
+// SetWriteFragmentSize sets the max payload size in bytes of each frame while
+// sending a message, a message larger than n is sent as continuation frames.
+// n == 0 means DefaultWriteFragmentSize, and NoFragmentation (n < 0) means
+// messages are never fragmented. It works on the next message.
+func (c *Conn) SetWriteFragmentSize(n int) {
+	c.writeFragmentSize = n
+}
+
+// fragmentSize returns the max payload size of each frame of outgoing
+// messages, 0 means no fragmentation.
+func (c *Conn) fragmentSize() int {
+	switch {
+	case c.writeFragmentSize == 0:
+		return DefaultWriteFragmentSize
+	case c.writeFragmentSize < 0:
+		return 0
+	}
+	return c.writeFragmentSize
+}
+
+// checkReadLimit closes Conn if size of message is over the read limit.
+func (c *Conn) checkReadLimit(size uint64) error {
+	if c.readLimit <= 0 || size <= uint64(c.readLimit) {
+		return nil
+	}
+
+	debugErrorf("Conn.checkReadLimit got message=%d over limit=%d", size, c.readLimit)
+	_ = c.close(CloseMessageTooBig)
+	return ErrReadLimit
+}
+
 // SetPongHandler handler would be called while the Conn
 func (c *Conn) SetPongHandler(handler func(s string)) {
 	c.pongHandler = handler
 }
 
-// Close .
+// SetPingHandler handler would be called while the Conn receives ping frame,
+// appData is the payload of ping. By default, pong with the same payload is
+// replied, and it's replaced by handler, so handler could call Pong to reply.
+// Error returned by handler is returned by read methods. nil means default.
+func (c *Conn) SetPingHandler(handler func(appData string) error) {
+	c.pingHandler = handler
+}
+
+// SetCloseHandler handler would be called while the Conn receives close frame,
+// before replying close frame with the same code and tearing down the Conn.
+// handler could call CloseWithCode to reply its own code and reason instead.
+// Read methods return *CloseError with code and text, or the error returned by
+// handler. nil means default, which does nothing more.
+func (c *Conn) SetCloseHandler(handler func(code int, text string) error) {
+	c.closeHandler = handler
+}
+
+// Close . closes the Conn with CloseNormalClosure, see CloseWithCode.
 func (c *Conn) Close() {
-	c.State = Closing
-	if err := c.close(CloseAbnormalClosure); err != nil {
+	if err := c.CloseWithCode(CloseNormalClosure, ""); err != nil {
 		debugErrorf("Conn.Close failed to close, err=%v", err)
 	}
 }
 
-// close ...
+// CloseWithCode starts the closing handshake. It sends close frame with code
+// and reason, then waits for close frame from peer while discarding data frames,
+// and closes underlying connection at last. If another goroutine is reading,
+// close frame from peer is received by it, and the read method would return
+// *CloseError. Waiting is bounded by a timeout, it's 5s by default, see
+// SetCloseTimeout.
+func (c *Conn) CloseWithCode(code int, reason string) (err error) {
+	if !isValidCloseCode(code) {
+		return ErrInvalidCloseCode
+	}
+	if len(reason) > maxCloseReasonLen {
+		return ErrCloseReasonTooLong
+	}
+
+	// only the first close works, sending data frames would fail since now.
+	if !c.casState(Connected, Closing) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.closeTimeout)
+	defer cancel()
+	if err = c.sendControlFrameContext(ctx, OpCodeClose, closePayload(code, reason)); err == nil {
+		c.waitClose(ctx)
+	}
+
+	c.abort()
+	return err
+}
+
+// waitClose waits for close frame from peer until ctx is done. It reads by
+// itself if no other goroutine is reading.
+func (c *Conn) waitClose(ctx context.Context) {
+	select {
+	case <-c.closeRecv:
+	case <-c.done:
+	case <-ctx.Done():
+	case c.readSem <- struct{}{}:
+		defer release(c.readSem)
+
+		stop := c.watchContext(ctx, true)
+		defer stop()
+		for {
+			// data messages are discarded by the next call
+			if _, _, err := c.nextReader(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// CloseStatus returns the code and reason of close frame from peer. Code is
+// CloseNoStatusReceived if peer sends no code, or CloseAbnormalClosure if Conn
+// is closed without receiving close frame. Code is 0 if Conn is not closed.
+func (c *Conn) CloseStatus() (code int, reason string) {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	switch {
+	case c.closeStatus != nil:
+		return c.closeStatus.Code, c.closeStatus.Text
+	case c.state == Closed:
+		return CloseAbnormalClosure, ""
+	}
+	return 0, ""
+}
+
+// close fails the Conn, it sends close frame with closeCode and closes underlying
+// connection without waiting for close frame from peer.
 // DONE: add close message to close frame
 func (c *Conn) close(closeCode int) (err error) {
-	// FIXME: do following work only when Conn is not receiving or sending
-	// wait other work finishing
-	p := make([]byte, 2, 16)
 	closeErr := &CloseError{Code: closeCode}
-	binary.BigEndian.PutUint16(p[:2], uint16(closeCode))
-	p = append(p, []byte(closeErr.Error())...)
+	return c.closeContext(context.Background(), closeCode, closeErr.Error())
+}
+
+// closeContext is same as close, but sending close frame is aborted once ctx
+// is done.
+func (c *Conn) closeContext(ctx context.Context, closeCode int, reason string) (err error) {
+	// only the first close works, sending data frames would fail since now.
+	if !c.casState(Connected, Closing) {
+		return nil
+	}
+
+	p := closePayload(closeCode, reason)
 	logger.Debugf("c.close sending close frame, payload=%s", p)
+	if err = c.sendControlFrameContext(ctx, OpCodeClose, p); err != nil {
+		debugErrorf("c.close failed to c.sendControlFrame, err=%v", err)
+	}
 
-	if err = c.sendControlFrame(opCodeClose, p); err != nil {
-		debugErrorf("c.handleClose failed to c.sendControlFrame, err=%v", err)
-		return
+	c.abort()
+	return err
+}
+
+// SetReadDeadline sets the deadline of reading from underlying connection, read
+// methods would fail with a net.Error whose Timeout() is true after deadline.
+// A zero value of t means no deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of writing to underlying connection, write
+// methods would fail with a net.Error whose Timeout() is true after deadline.
+// Since the frame may be written partially, the Conn is closed if write fails.
+// A zero value of t means no deadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetDeadline sets both read and write deadline, same as calling SetReadDeadline
+// and SetWriteDeadline.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.deadlineMu.Unlock()
+	return c.conn.SetDeadline(t)
+}
+
+// watchContext interrupts blocking read (or write) on underlying connection by
+// setting a passed deadline once ctx is done. stop MUST be called after I/O, it
+// restores the deadline set by user, and reports whether I/O is interrupted.
+func (c *Conn) watchContext(ctx context.Context, read bool) (stop func() bool) {
+	if ctx.Done() == nil || c.conn == nil {
+		return func() bool { return false }
 	}
 
-	if c.conn != nil {
-		// close underlying TCP connection
-		defer func() { _ = c.conn.Close() }()
+	setDeadline := c.conn.SetWriteDeadline
+	if read {
+		setDeadline = c.conn.SetReadDeadline
 	}
-	// update Conn's State to 'Closed'
-	c.State = Closed
-	return nil
+
+	var (
+		done        = make(chan struct{})
+		exited      = make(chan struct{})
+		interrupted bool
+	)
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			interrupted = true
+			_ = setDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		<-exited
+		if interrupted {
+			c.deadlineMu.Lock()
+			deadline := c.writeDeadline
+			if read {
+				deadline = c.readDeadline
+			}
+			c.deadlineMu.Unlock()
+			_ = setDeadline(deadline)
+		}
+		return interrupted
+	}
+}
+
+// State returns Conn current state.
+func (c *Conn) State() ConnState {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.state
+}
+
+// setState .
+func (c *Conn) setState(state ConnState) {
+	c.stateMu.Lock()
+	c.state = state
+	c.stateMu.Unlock()
+
+	if state == Closed {
+		c.doneOnce.Do(func() { close(c.done) })
+	}
+}
+
+// casState changes state to new only if it's old now, and reports whether
+// the state has been changed.
+func (c *Conn) casState(old, new ConnState) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state != old {
+		return false
+	}
+	c.state = new
+	return true
 }
 
 // Connected .
 func (c *Conn) Connected() bool {
-	return c.State == Connected
+	return c.State() == Connected
+}
+
+// rsvBits returns the reserved bits which are owned by negotiated extensions.
+func (c *Conn) rsvBits() (rsv uint16) {
+	for _, ext := range c.extensions {
+		rsv |= ext.RSV()
+	}
+	return rsv
+}
+
+// encodeDataFrame applies extensions on the frame which is not masked, then
+// mask the payload if Conn is working on client side.
+func (c *Conn) encodeDataFrame(frm *Frame) error {
+	for _, ext := range c.extensions {
+		if err := ext.EncodeFrame(frm); err != nil {
+			return err
+		}
+	}
+
+	c.maskFrame(frm)
+	return nil
+}
+
+// maskFrame masks the payload of frame which is not masked, if Conn is working
+// on client side.
+func (c *Conn) maskFrame(frm *Frame) {
+	if !c.isServer {
+		// mask a copy of payload, caller's data should not be modified
+		frm.Mask = 1
+		frm.genMaskingKey()
+		frm.Payload = append([]byte(nil), frm.Payload...)
+	}
+	frm.setPayload(frm.Payload)
+}
+
+// streamDecoder returns the extension which decodes messages as a stream, it
+// works only if it's the only negotiated extension.
+func (c *Conn) streamDecoder() streamDecoder {
+	if len(c.extensions) != 1 {
+		return nil
+	}
+	sd, _ := c.extensions[0].(streamDecoder)
+	return sd
+}
+
+// limitDecode bounds the payload of next frame decoded by extensions, n is the
+// rest of read limit, negative means no limit.
+func (c *Conn) limitDecode(n int64) {
+	for _, ext := range c.extensions {
+		if l, ok := ext.(decodeLimiter); ok {
+			l.limitDecode(n)
+		}
+	}
+}
+
+// decodeDataFrame applies extensions on the unmasked frame in reverse order.
+func (c *Conn) decodeDataFrame(frm *Frame) error {
+	switch frm.OpCode {
+	case OpCodeText, OpCodeBinary, OpCodeContinuation:
+	default:
+		return nil
+	}
+
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		if err := c.extensions[i].DecodeFrame(frm); err != nil {
+			return err
+		}
+	}
+	frm.autoCalcPayloadLen()
+	return nil
 }
 
 // readFrame to call
 func (c *Conn) validFrame(frm *Frame) error {
+	// extensions never work on control frames, so reserved bits MUST be 0
+	if frm.OpCode >= OpCodeClose && (frm.RSV1 != 0 || frm.RSV2 != 0 || frm.RSV3 != 0) {
+		return newInvalidFrameError("reserved bit is set on control frame")
+	}
+
 	if c.isServer {
 		// frame from client
 		if frm.Mask != 1 {
@@ -3,9 +3,17 @@ package websocket
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -18,7 +26,15 @@ func mockConn(rw io.ReadWriter) *Conn {
 		bufRD: bufio.NewReaderSize(rw, 65535),
 		bufWR: bufio.NewWriter(rw),
 
-		State: Connected,
+		state: Connected,
+		done:  make(chan struct{}),
+
+		closeRecv:    make(chan struct{}),
+		closeTimeout: defaultCloseTimeout,
+
+		msgSem:   make(chan struct{}, 1),
+		writeSem: make(chan struct{}, 1),
+		readSem:  make(chan struct{}, 1),
 
 		isServer: true,
 	}
@@ -154,7 +170,7 @@ func Test_Conn_PingPong(t *testing.T) {
 		t.Error(err)
 		t.FailNow()
 	}
-	assert.Equal(t, pingFrm.OpCode, opCodePing)
+	assert.Equal(t, pingFrm.OpCode, OpCodePing)
 	assert.Equal(t, pingFrm.Fin, uint16(1))
 	assert.GreaterOrEqual(t, pingFrm.PayloadLen, uint16(0))
 
@@ -170,10 +186,9 @@ func Test_Conn_PingPong(t *testing.T) {
 		t.Error(err)
 		t.FailNow()
 	}
-	assert.Equal(t, pongFrm.OpCode, opCodePong)
+	assert.Equal(t, pongFrm.OpCode, OpCodePong)
 	assert.Equal(t, pongFrm.Fin, uint16(1))
 	assert.GreaterOrEqual(t, pongFrm.PayloadLen, uint16(0))
-	pongFrm.maskPayload()
 	assert.Equal(t, pongFrm.Payload, pingFrm.Payload)
 	if err = conn.replyPong(pingFrm); err != nil {
 		t.Error(err)
@@ -189,12 +204,81 @@ func Test_Conn_PongHandler(t *testing.T) {
 		pongHandlerCalledCnt++
 	})
 
-	pongFrm := constructControlFrame(opCodePing, true, []byte("pingping"))
+	pongFrm := constructControlFrame(OpCodePing, true, []byte("pingping"))
 	err := conn.replyPong(pongFrm)
 	assert.Nil(t, err)
 	assert.Equal(t, 1, pongHandlerCalledCnt)
 }
 
+func Test_Conn_PingHandler(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	// mock client send ping
+	conn.isServer = false
+	require.Nil(t, conn.sendControlFrame(OpCodePing, []byte("telemetry")))
+	require.Nil(t, conn.sendDataFrame([]byte("hello"), OpCodeText))
+
+	// server handles ping by handler, no pong is replied
+	conn.isServer = true
+	var appData string
+	conn.SetPingHandler(func(s string) error {
+		appData = s
+		return nil
+	})
+	_, msg, err := conn.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(msg))
+	assert.Equal(t, "telemetry", appData)
+	assert.Equal(t, 0, buf.Len())
+
+	// error of handler is returned
+	conn.isServer = false
+	require.Nil(t, conn.Ping())
+	conn.isServer = true
+	handlerErr := errors.New("ping handler error")
+	conn.SetPingHandler(func(s string) error {
+		return handlerErr
+	})
+	_, _, err = conn.ReadMessage()
+	assert.Equal(t, handlerErr, err)
+}
+
+func Test_Conn_CloseHandler(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	// mock client send close frame
+	conn.isServer = false
+	p := append([]byte{0x03, 0xe9}, "bye"...)
+	require.Nil(t, conn.sendControlFrame(OpCodeClose, p))
+
+	conn.isServer = true
+	var (
+		gotCode int
+		gotText string
+	)
+	conn.SetCloseHandler(func(code int, text string) error {
+		gotCode, gotText = code, text
+		return nil
+	})
+	_, _, err := conn.ReadMessage()
+	assert.Equal(t, &CloseError{Code: CloseGoingAway, Text: "bye"}, err)
+	assert.Equal(t, CloseGoingAway, gotCode)
+	assert.Equal(t, "bye", gotText)
+
+	// close frame with the same code is replied
+	assert.Equal(t, Closed, conn.State())
+	conn.isServer = false
+	conn.setState(Connected)
+	frm, err := conn.readFrame()
+	require.NotNil(t, frm)
+	assert.Equal(t, OpCodeClose, frm.OpCode)
+	closeErr, ok := err.(*CloseError)
+	require.True(t, ok)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+}
+
 func Test_Conn_close(t *testing.T) {
 	buf := bytes.NewBuffer(nil)
 	conn := mockConn(buf)
@@ -208,7 +292,7 @@ func Test_Conn_close(t *testing.T) {
 	}
 
 	conn.isServer = false
-	conn.State = Connected
+	conn.setState(Connected)
 	frm, err := conn.readFrame()
 	if err != nil {
 		closeErr2, ok := err.(*CloseError)
@@ -222,7 +306,7 @@ func Test_Conn_close(t *testing.T) {
 	}
 	require.NotNil(t, frm)
 
-	assert.Equal(t, frm.OpCode, opCodeClose)
+	assert.Equal(t, frm.OpCode, OpCodeClose)
 	assert.Equal(t, frm.Fin, uint16(1))
 }
 
@@ -231,12 +315,12 @@ func Test_Conn_sendDataFrame(t *testing.T) {
 	conn := mockConn(buf)
 	payload := []byte("goodbye")
 
-	if err := conn.sendDataFrame(payload, opCodeContinuation); err == nil {
+	if err := conn.sendDataFrame(payload, OpCodeContinuation); err == nil {
 		t.Error("could not pass invalid opCode")
 		t.FailNow()
 	}
 
-	if err := conn.sendDataFrame(payload, opCodeText); err != nil {
+	if err := conn.sendDataFrame(payload, OpCodeText); err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
@@ -286,3 +370,611 @@ func Benchmark_Conn_SendAndRead_BiggerThan65535(b *testing.B) {
 		assert.Nil(b, err)
 	}
 }
+
+func Test_Conn_ConcurrentSend(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	var pongCnt int32
+	conn.SetPongHandler(func(s string) {
+		atomic.AddInt32(&pongCnt, 1)
+	})
+
+	const senders, messages = 4, 10
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				// large message would be fragmented
+				size := 10
+				if j%2 == 0 {
+					size = 65535*2 + 10
+				}
+				p := bytes.Repeat([]byte{byte('a' + i)}, size)
+				if j%3 == 0 {
+					assert.Nil(t, conn.SendBinary(bytes.NewReader(p)))
+				} else {
+					assert.Nil(t, conn.SendMessage(string(p)))
+				}
+			}
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			assert.Nil(t, conn.Ping())
+		}
+	}()
+
+	// every message must not be interleaved with others
+	for i := 0; i < senders*messages; i++ {
+		_, msg, err := conn.ReadMessage()
+		require.Nil(t, err)
+		require.NotEmpty(t, msg)
+		assert.Equal(t, bytes.Repeat(msg[:1], len(msg)), msg)
+	}
+	wg.Wait()
+
+	// pongs are handled only while reading, the echo of the last message comes
+	// after all pongs, since server replies pings before reading it.
+	require.Nil(t, conn.SendMessage("end"))
+	for {
+		_, msg, err := conn.ReadMessage()
+		require.Nil(t, err)
+		if string(msg) == "end" {
+			break
+		}
+	}
+	assert.Equal(t, int32(messages), atomic.LoadInt32(&pongCnt))
+}
+
+func Test_Conn_ConcurrentClose(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL)
+	require.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if err := conn.SendMessage("hello"); err != nil {
+					return
+				}
+				_ = conn.Ping()
+			}
+		}()
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		conn.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		conn.Close()
+	}()
+	wg.Wait()
+
+	assert.Equal(t, Closed, conn.State())
+	assert.Equal(t, ErrNotConnected, conn.SendMessage("hello"))
+}
+
+func Test_Conn_ReadDeadline(t *testing.T) {
+	// server never sends
+	done := make(chan struct{})
+	defer close(done)
+	srv, wsURL := newTestServer(Upgrader{}, func(conn *Conn) {
+		<-done
+		conn.Close()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, _, err = conn.ReadMessage()
+	require.Error(t, err)
+	netErr, ok := err.(net.Error)
+	require.True(t, ok)
+	assert.True(t, netErr.Timeout())
+}
+
+func Test_Conn_WriteDeadline(t *testing.T) {
+	// server never reads, so that writing would be blocked
+	done := make(chan struct{})
+	defer close(done)
+	srv, wsURL := newTestServer(Upgrader{}, func(conn *Conn) {
+		<-done
+		conn.Close()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL)
+	require.Nil(t, err)
+
+	require.Nil(t, conn.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+	data := make([]byte, 1<<20)
+	for err == nil {
+		err = conn.SendBinary(bytes.NewReader(data))
+	}
+	netErr, ok := err.(net.Error)
+	require.True(t, ok)
+	assert.True(t, netErr.Timeout())
+
+	// the Conn has been closed
+	assert.Equal(t, Closed, conn.State())
+	assert.Equal(t, ErrNotConnected, conn.SendMessage("hello"))
+}
+
+func Test_Conn_ReadMessageContext(t *testing.T) {
+	texts := []string{"split in header", "split in payload"}
+	splits := []int{1, 5}
+
+	// server sends each frame in two parts, the second part is sent after
+	// client's reading has been aborted.
+	next := make(chan struct{})
+	srv, wsURL := newTestServer(Upgrader{}, func(conn *Conn) {
+		for i, text := range texts {
+			data := encodeFrameTo(constructDataFrame([]byte(text), true, OpCodeText))
+			_, _ = conn.conn.Write(data[:splits[i]])
+			<-next
+			_, _ = conn.conn.Write(data[splits[i]:])
+		}
+		<-next
+		conn.Close()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	for _, text := range texts {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, _, err = conn.ReadMessageContext(ctx)
+		cancel()
+		assert.Equal(t, context.DeadlineExceeded, err)
+
+		// reading is resumed
+		next <- struct{}{}
+		mt, msg, err := conn.ReadMessageContext(context.Background())
+		require.Nil(t, err)
+		assert.Equal(t, TextMessage, mt)
+		assert.Equal(t, text, string(msg))
+	}
+	next <- struct{}{}
+
+	// cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = conn.ReadMessageContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func Test_Conn_WriteMessageContext(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	// abort while waiting for the previous message
+	w, err := conn.NextWriter(TextMessage)
+	require.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err = conn.WriteMessageContext(ctx, TextMessage, []byte("aborted"))
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, err = w.Write([]byte("first"))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+
+	// nothing of aborted message has been sent
+	require.Nil(t, conn.WriteMessageContext(context.Background(), TextMessage, []byte("second")))
+	for _, want := range []string{"first", "second"} {
+		_, msg, err := conn.ReadMessage()
+		require.Nil(t, err)
+		assert.Equal(t, want, string(msg))
+	}
+}
+
+func Test_Conn_WriteMessageContext_closed(t *testing.T) {
+	netconn, peer := net.Pipe()
+	defer peer.Close()
+	conn, err := newConn(netconn, false, bufferOptions{})
+	require.Nil(t, err)
+	conn.setState(Connected)
+
+	// peer reads a part of the message then stops reading, so that writing
+	// would be blocked after the message has been sent partially.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_, _ = io.ReadFull(peer, make([]byte, 1000))
+		cancel()
+	}()
+
+	err = conn.WriteMessageContext(ctx, BinaryMessage, make([]byte, 200000))
+	assert.Equal(t, context.Canceled, err)
+
+	// the message has been sent partially, so the Conn is closed
+	assert.Equal(t, Closed, conn.State())
+}
+
+func Test_Conn_PingContext(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, conn.PingContext(ctx))
+	assert.True(t, conn.Connected())
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, conn.PingContext(ctx))
+}
+
+func Test_Conn_CloseWithCode(t *testing.T) {
+	// server sends a message, then reads until close frame comes
+	type status struct {
+		err  error
+		code int
+		text string
+	}
+	result := make(chan status, 1)
+	srv, wsURL := newTestServer(Upgrader{}, func(conn *Conn) {
+		_ = conn.SendMessage("discarded")
+		_, _, err := conn.ReadMessage()
+		code, text := conn.CloseStatus()
+		result <- status{err: err, code: code, text: text}
+	})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL)
+	require.Nil(t, err)
+	code, _ := conn.CloseStatus()
+	assert.Equal(t, 0, code)
+
+	// invalid code and reason
+	assert.Equal(t, ErrInvalidCloseCode, conn.CloseWithCode(CloseAbnormalClosure, ""))
+	assert.Equal(t, ErrCloseReasonTooLong, conn.CloseWithCode(CloseGoingAway, strings.Repeat("a", 124)))
+	assert.True(t, conn.Connected())
+
+	require.Nil(t, conn.CloseWithCode(CloseGoingAway, "bye"))
+	assert.Equal(t, Closed, conn.State())
+
+	// server echoes the code
+	code, text := conn.CloseStatus()
+	assert.Equal(t, CloseGoingAway, code)
+	assert.Equal(t, "", text)
+
+	got := <-result
+	assert.Equal(t, &CloseError{Code: CloseGoingAway, Text: "bye"}, got.err)
+	assert.Equal(t, CloseGoingAway, got.code)
+	assert.Equal(t, "bye", got.text)
+}
+
+func Test_Conn_CloseWithCode_reading(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL)
+	require.Nil(t, err)
+
+	// close frame from server is received by the reading goroutine
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		readErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	require.Nil(t, conn.CloseWithCode(CloseNormalClosure, ""))
+	assert.Equal(t, &CloseError{Code: CloseNormalClosure}, <-readErr)
+	code, _ := conn.CloseStatus()
+	assert.Equal(t, CloseNormalClosure, code)
+}
+
+func Test_Conn_CloseWithCode_timeout(t *testing.T) {
+	// server never reads, so that close frame would not be replied
+	done := make(chan struct{})
+	defer close(done)
+	srv, wsURL := newTestServer(Upgrader{}, func(conn *Conn) {
+		<-done
+		conn.Close()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL)
+	require.Nil(t, err)
+	conn.SetCloseTimeout(0)
+	assert.Equal(t, defaultCloseTimeout, conn.closeTimeout)
+	conn.SetCloseTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	require.Nil(t, conn.CloseWithCode(CloseNormalClosure, ""))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+	assert.Equal(t, Closed, conn.State())
+	code, _ := conn.CloseStatus()
+	assert.Equal(t, CloseAbnormalClosure, code)
+}
+
+func Test_Conn_SetReadLimit(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	// mock client send a message in two frames
+	conn.isServer = false
+	require.Nil(t, conn.sendDataFrame(make([]byte, 65535+100), OpCodeBinary))
+
+	// the second frame is over limit
+	conn.isServer = true
+	conn.SetReadLimit(65535 + 10)
+	_, r, err := conn.NextReader()
+	require.Nil(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrReadLimit, err)
+	assert.Equal(t, Closed, conn.State())
+}
+
+func Test_Conn_maxFrameSize(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	conn.isServer = false
+	require.Nil(t, conn.sendDataFrame(make([]byte, 200), OpCodeBinary))
+
+	conn.isServer = true
+	conn.maxFrameSize = 100
+	_, _, err := conn.ReadMessage()
+	assert.Equal(t, ErrReadLimit, err)
+	assert.Equal(t, Closed, conn.State())
+}
+
+func Test_Conn_ReadLimit_compression(t *testing.T) {
+	// message is checked after decompression
+	srv, wsURL := newEchoServer(Upgrader{EnableCompression: true, MaxMessageSize: 1000})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL, WithCompression(CompressionOptions{}))
+	require.Nil(t, err)
+	require.Nil(t, conn.SendMessage(strings.Repeat("a", 10000)))
+
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*CloseError)
+	require.True(t, ok)
+	assert.Equal(t, CloseMessageTooBig, closeErr.Code)
+}
+
+func Test_Conn_hugeFrameLength(t *testing.T) {
+	// a frame header claims 1TB payload, but nothing follows it
+	header := []byte{0xC2, 0xFF, 0, 0, 1, 0, 0, 0, 0, 0, 1, 2, 3, 4}
+	tests := []struct {
+		name       string
+		extensions []Extension
+		wantErr    error
+	}{
+		{name: "no extension", wantErr: ErrUnexpectedEOF},
+		{
+			name:       "decompressed as stream",
+			extensions: []Extension{newPermessageDeflate(CompressionOptions{}).instance(true)},
+			wantErr:    ErrUnexpectedEOF,
+		},
+		{
+			name:       "buffered to be decoded",
+			extensions: []Extension{newPermessageDeflate(CompressionOptions{}).instance(true), &xorExtension{key: 42}},
+			wantErr:    ErrReadLimit,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.extensions) == 0 {
+				header[0] = 0x82
+			}
+			conn := mockConn(bytes.NewBuffer(append([]byte(nil), header...)))
+			conn.extensions = tt.extensions
+
+			_, r, err := conn.NextReader()
+			if err == nil {
+				_, err = ioutil.ReadAll(r)
+			}
+			assert.Equal(t, tt.wantErr, err)
+		})
+	}
+}
+
+func Test_Conn_ReadLimit_decompressionBomb(t *testing.T) {
+	data := make([]byte, 4<<20)
+	for _, withXor := range []bool{false, true} {
+		client := []Extension{newPermessageDeflate(CompressionOptions{}).instance(false)}
+		server := []Extension{newPermessageDeflate(CompressionOptions{}).instance(true)}
+		if withXor {
+			// frames are decoded one by one rather than as a stream
+			client = append(client, &xorExtension{key: 42})
+			server = append(server, &xorExtension{key: 42})
+		}
+
+		buf := bytes.NewBuffer(nil)
+		conn := mockConn(buf)
+		conn.isServer, conn.extensions = false, client
+		conn.SetWriteFragmentSize(NoFragmentation)
+		require.Nil(t, conn.sendDataFrame(data, OpCodeBinary))
+		require.Less(t, buf.Len(), 256<<10)
+
+		conn.isServer, conn.extensions = true, server
+		conn.SetReadLimit(256 << 10)
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, _, err := conn.ReadMessage()
+		runtime.ReadMemStats(&after)
+		assert.Equal(t, ErrReadLimit, err)
+		// decompressed data is bounded by read limit rather than the message
+		assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(len(data)))
+	}
+}
+
+func Test_Conn_readFrameHeader_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{name: "reserved opcode", data: []byte{0x83, 0x00}, want: ErrReservedOpCode},
+		{name: "fragmented ping", data: []byte{0x09, 0x00}, want: ErrFragmentedControlFrame},
+		{name: "ping over 125 bytes", data: []byte{0x89, 0x7E, 0x00, 0x7E}, want: ErrControlFrameTooBig},
+		{name: "non-minimal 16-bit length", data: []byte{0x81, 0x7E, 0x00, 0x05}, want: ErrNonMinimalLength},
+		{name: "non-minimal 64-bit length", data: []byte{0x82, 0x7F, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF}, want: ErrNonMinimalLength},
+		{name: "continuation without message", data: []byte{0x80, 0x00}, want: ErrUnexpectedContinuation},
+		{name: "data frame in fragmented message", data: []byte{0x01, 0x01, 'a', 0x81, 0x00}, want: ErrContinuationExpected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// mock client read frames from server without mask
+			buf := bytes.NewBuffer(nil)
+			conn := mockConn(buf)
+			conn.isServer = false
+			buf.Write(tt.data)
+
+			_, _, err := conn.ReadMessage()
+			assert.Equal(t, tt.want, err)
+			assert.Equal(t, Closed, conn.State())
+
+			// close frame with CloseProtocolError is sent
+			conn.setState(Connected)
+			conn.isServer = true
+			_, err = conn.readFrame()
+			closeErr, ok := err.(*CloseError)
+			require.True(t, ok)
+			assert.Equal(t, CloseProtocolError, closeErr.Code)
+		})
+	}
+}
+
+func Test_Conn_handleClose_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    error
+	}{
+		{name: "1 byte payload", payload: []byte{0x03}, want: ErrInvalidClosePayload},
+		{name: "no status", payload: nil, want: &CloseError{Code: CloseNoStatusReceived}},
+		{name: "1006", payload: []byte{0x03, 0xee}, want: ErrInvalidClosePayload},
+		{name: "1015", payload: []byte{0x03, 0xf7}, want: ErrInvalidClosePayload},
+		{name: "unassigned 2000", payload: []byte{0x07, 0xd0}, want: ErrInvalidClosePayload},
+		{name: "application 4000", payload: []byte{0x0f, 0xa0}, want: &CloseError{Code: 4000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			conn := mockConn(buf)
+
+			conn.isServer = false
+			require.Nil(t, conn.sendControlFrame(OpCodeClose, tt.payload))
+			conn.isServer = true
+			_, _, err := conn.ReadMessage()
+			assert.Equal(t, tt.want, err)
+			assert.Equal(t, Closed, conn.State())
+		})
+	}
+}
+
+func Test_newConn_buffers(t *testing.T) {
+	netconn, peer := net.Pipe()
+	defer netconn.Close()
+	defer peer.Close()
+
+	// default sizes
+	conn, err := newConn(netconn, true, bufferOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, _FragmentLimit, conn.bufRD.Size())
+	assert.Equal(t, defaultWriteBufferSize, conn.bufWR.Size())
+
+	// hijacked buffers are reused if they are large enough
+	br := bufio.NewReaderSize(netconn, 4096)
+	bw := bufio.NewWriterSize(netconn, 4096)
+	conn, err = newConn(netconn, true, bufferOptions{readBufferSize: 1024, br: br, bw: bw})
+	require.Nil(t, err)
+	assert.True(t, br == conn.bufRD)
+	assert.True(t, bw == conn.bufWR)
+
+	// too small read buffer size is raised to minReadBufferSize
+	conn, err = newConn(netconn, true, bufferOptions{readBufferSize: 16, writeBufferSize: 8192, bw: bw})
+	require.Nil(t, err)
+	assert.Equal(t, minReadBufferSize, conn.bufRD.Size())
+	assert.Equal(t, 8192, conn.bufWR.Size())
+
+	// no write buffer is held while pool is set
+	conn, err = newConn(netconn, true, bufferOptions{writePool: &sync.Pool{}})
+	require.Nil(t, err)
+	assert.Nil(t, conn.bufWR)
+}
+
+func Test_newConn_hijackedBuffered(t *testing.T) {
+	// client sends a frame along with the upgrade request, it's buffered
+	// by hijacked reader which is smaller than read buffer.
+	data := bytes.NewBuffer(nil)
+	client := mockConn(data)
+	client.isServer = false
+	require.Nil(t, client.SendMessage("early"))
+
+	req := append([]byte("GET / HTTP/1.1\r\n\r\n"), data.Bytes()...)
+	br := bufio.NewReaderSize(bytes.NewReader(req), 32)
+	_, err := br.ReadString('\n')
+	require.Nil(t, err)
+	_, err = br.ReadString('\n')
+	require.Nil(t, err)
+	require.NotZero(t, br.Buffered())
+
+	netconn, peer := net.Pipe()
+	defer netconn.Close()
+	defer peer.Close()
+	conn, err := newConn(netconn, true, bufferOptions{br: br})
+	require.Nil(t, err)
+	conn.setState(Connected)
+
+	_, msg, err := conn.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "early", string(msg))
+}
+
+func Test_Conn_smallReadBuffer(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+	conn.bufRD = bufio.NewReaderSize(buf, minReadBufferSize)
+
+	// frame is larger than read buffer
+	data := bytes.Repeat([]byte("abc"), 1000)
+	conn.isServer = false
+	require.Nil(t, conn.WriteMessage(BinaryMessage, data))
+	require.Nil(t, conn.WriteMessage(BinaryMessage, data))
+
+	conn.isServer = true
+	frm, err := conn.readFrame()
+	require.Nil(t, err)
+	assert.Equal(t, data, frm.Payload)
+	_, msg, err := conn.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, data, msg)
+}
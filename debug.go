@@ -2,12 +2,15 @@ package websocket
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/yeqown/log"
 )
 
 var (
-	_debug = false
+	// _debug is accessed atomically, since SetDebug could be called while
+	// Conns are working.
+	_debug int32
 	logger *log.Logger
 )
 
@@ -15,7 +18,7 @@ func init() {
 	logger, _ = log.NewLogger()
 	logger.SetLogLevel(log.LevelInfo)
 
-	if _debug {
+	if debugEnabled() {
 		logger.SetLogLevel(log.LevelDebug)
 	}
 }
@@ -23,14 +26,18 @@ func init() {
 // SetDebug . open debug mode
 func SetDebug(debug bool) {
 	if debug {
-		_debug = debug
+		atomic.StoreInt32(&_debug, 1)
 		logger.SetLogLevel(log.LevelDebug)
 	}
 }
 
+func debugEnabled() bool {
+	return atomic.LoadInt32(&_debug) == 1
+}
+
 // debugPrintEncodedFrame print []byte into bits into stdout
 func debugPrintEncodedFrame(encoded []byte) {
-	if !_debug {
+	if !debugEnabled() {
 		return
 	}
 
@@ -54,7 +61,7 @@ func debugPrintEncodedFrame(encoded []byte) {
 }
 
 func debugErrorf(format string, args ...interface{}) {
-	if !_debug {
+	if !debugEnabled() {
 		return
 	}
 
@@ -66,7 +73,7 @@ func formatUint16(v uint16) string {
 }
 
 func debugPrintFrame(frm *Frame) {
-	if !_debug {
+	if !debugEnabled() {
 		return
 	}
 
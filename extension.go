@@ -0,0 +1,225 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// reserved bits which could be claimed by Extension, to be returned by Extension.RSV().
+const (
+	RSV1Bit uint16 = rsv1Mask
+	RSV2Bit uint16 = rsv2Mask
+	RSV3Bit uint16 = rsv3Mask
+)
+
+var (
+	// ErrInvalidExtension .
+	ErrInvalidExtension = errors.New("websocket: invalid extension negotiation")
+)
+
+// ExtensionParams are parameters of an extension in Sec-WebSocket-Extensions
+// header, a parameter without value is mapped to "".
+type ExtensionParams map[string]string
+
+// Extension is an WebSocket extension, RFC6455 Section-9. An Extension set on
+// Upgrader or DialOption works as a template, negotiation creates an new
+// Extension for each Conn, so that it could keep states of the Conn.
+//
+// Extension only works on data frames [text, binary, continuation], control
+// frames never pass through it.
+type Extension interface {
+	// Name is the extension token in Sec-WebSocket-Extensions header.
+	Name() string
+
+	// Offer returns the parameters which client offers to server.
+	Offer() ExtensionParams
+
+	// Accept is called by server with the parameters offered by client, it
+	// returns the parameters to respond and the Extension to use on Conn,
+	// or nil Extension to decline the offer.
+	Accept(offer ExtensionParams) (ExtensionParams, Extension)
+
+	// Configure is called by client with the parameters responded by server,
+	// it returns the Extension to use on Conn, or error to fail the handshake.
+	Configure(resp ExtensionParams) (Extension, error)
+
+	// RSV returns the reserved bits claimed by the extension, composed by
+	// RSV1Bit, RSV2Bit and RSV3Bit.
+	RSV() uint16
+
+	// EncodeFrame transforms outgoing data frame before it is masked.
+	EncodeFrame(frm *Frame) error
+
+	// DecodeFrame transforms incoming data frame after it is unmasked,
+	// returns *CloseError to decide the close code.
+	DecodeFrame(frm *Frame) error
+}
+
+// streamDecoder is implemented by Extension which decodes the payload of a
+// message as a stream, e.g. permessage-deflate, so that large message is never
+// buffered in whole. It's used only if it's the only negotiated extension,
+// otherwise frames are decoded by DecodeFrame one by one.
+type streamDecoder interface {
+	// decodeStream returns the reader of decoded payload of the message
+	// whose first frame is frm, payload yields the payload across frames.
+	// nil means the message is not encoded by the extension.
+	decodeStream(frm *Frame, payload io.Reader) (io.Reader, error)
+}
+
+// decodeLimiter is implemented by Extension which inflates the payload, e.g.
+// permessage-deflate, so that it stops decoding once the payload is over the
+// read limit.
+type decodeLimiter interface {
+	// limitDecode bounds the decoded payload of next frame, at most n+1 bytes
+	// are decoded so that it's found over the limit. Negative n means no
+	// limit.
+	limitDecode(n int64)
+}
+
+// extensionOffer is an element of Sec-WebSocket-Extensions header.
+// eg. "permessage-deflate; client_max_window_bits; server_max_window_bits=10"
+type extensionOffer struct {
+	name   string
+	params ExtensionParams
+}
+
+// parseExtensions parse all Sec-WebSocket-Extensions headers into offers
+// with the same order, RFC6455 Section-9.1
+func parseExtensions(header http.Header) []extensionOffer {
+	var offers []extensionOffer
+
+	for _, h := range header["Sec-Websocket-Extensions"] {
+		for _, ext := range strings.Split(h, ",") {
+			parts := strings.Split(ext, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+
+			offer := extensionOffer{name: name, params: make(ExtensionParams)}
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(param, "=", 2)
+				k := strings.TrimSpace(kv[0])
+				if k == "" {
+					continue
+				}
+				v := ""
+				if len(kv) == 2 {
+					v = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+				}
+				offer.params[k] = v
+			}
+			offers = append(offers, offer)
+		}
+	}
+
+	return offers
+}
+
+// formatExtension format extension into an element of Sec-WebSocket-Extensions
+// header, params are sorted to keep the output stable.
+func formatExtension(name string, params ExtensionParams) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := name
+	for _, k := range keys {
+		s += "; " + k
+		if v := params[k]; v != "" {
+			s += "=" + v
+		}
+	}
+	return s
+}
+
+// offerExtensions generates the client offer of negotiation.
+func offerExtensions(exts []Extension) string {
+	elems := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		elems = append(elems, formatExtension(ext.Name(), ext.Offer()))
+	}
+	return strings.Join(elems, ", ")
+}
+
+// acceptExtensions is used by server to choose extensions from the client's
+// offers, the first acceptable offer of each extension would be chosen. It
+// returns the accepted extensions and the response header value.
+func acceptExtensions(exts []Extension, offers []extensionOffer) ([]Extension, string) {
+	var (
+		accepted []Extension
+		elems    []string
+		rsv      uint16
+	)
+
+	for _, offer := range offers {
+		for _, ext := range exts {
+			if ext.Name() != offer.name || containsExtension(accepted, offer.name) {
+				continue
+			}
+			// reserved bits could not be claimed by more than one extension
+			if rsv&ext.RSV() != 0 {
+				continue
+			}
+
+			params, instance := ext.Accept(offer.params)
+			if instance == nil {
+				continue
+			}
+			accepted = append(accepted, instance)
+			elems = append(elems, formatExtension(offer.name, params))
+			rsv |= instance.RSV()
+		}
+	}
+
+	return accepted, strings.Join(elems, ", ")
+}
+
+// configureExtensions is used by client to verify the server's response,
+// server MUST only respond extensions which are offered by client.
+func configureExtensions(exts []Extension, resps []extensionOffer) ([]Extension, error) {
+	var (
+		configured []Extension
+		rsv        uint16
+	)
+
+	for _, resp := range resps {
+		var offered Extension
+		for _, ext := range exts {
+			if ext.Name() == resp.name {
+				offered = ext
+				break
+			}
+		}
+		if offered == nil || containsExtension(configured, resp.name) {
+			return nil, fmt.Errorf("%w: unexpected extension=%s", ErrInvalidExtension, resp.name)
+		}
+
+		instance, err := offered.Configure(resp.params)
+		if err != nil {
+			return nil, err
+		}
+		if rsv&instance.RSV() != 0 {
+			return nil, fmt.Errorf("%w: reserved bits conflict, extension=%s", ErrInvalidExtension, resp.name)
+		}
+		configured = append(configured, instance)
+		rsv |= instance.RSV()
+	}
+
+	return configured, nil
+}
+
+func containsExtension(exts []Extension, name string) bool {
+	for _, ext := range exts {
+		if ext.Name() == name {
+			return true
+		}
+	}
+	return false
+}
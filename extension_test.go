@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// xorExtension is an extension for testing, it XORs payload of data frames
+// with key and marks RSV3 on each frame.
+type xorExtension struct {
+	key byte
+}
+
+func (x *xorExtension) Name() string { return "x-xor" }
+
+func (x *xorExtension) Offer() ExtensionParams { return ExtensionParams{"key": "42"} }
+
+func (x *xorExtension) Accept(offer ExtensionParams) (ExtensionParams, Extension) {
+	if offer["key"] != "42" {
+		return nil, nil
+	}
+	return offer, &xorExtension{key: 42}
+}
+
+func (x *xorExtension) Configure(resp ExtensionParams) (Extension, error) {
+	return &xorExtension{key: 42}, nil
+}
+
+func (x *xorExtension) RSV() uint16 { return RSV3Bit }
+
+func (x *xorExtension) EncodeFrame(frm *Frame) error {
+	frm.RSV3 = 1
+	x.xor(frm.Payload)
+	return nil
+}
+
+func (x *xorExtension) DecodeFrame(frm *Frame) error {
+	if frm.RSV3 != 1 {
+		return newInvalidFrameError("RSV3 not set")
+	}
+	x.xor(frm.Payload)
+	return nil
+}
+
+func (x *xorExtension) xor(p []byte) {
+	for i := range p {
+		p[i] ^= x.key
+	}
+}
+
+func Test_parseExtensions(t *testing.T) {
+	header := http.Header{}
+	header.Add("Sec-WebSocket-Extensions", `permessage-deflate; client_max_window_bits, permessage-deflate; server_max_window_bits="10"`)
+	header.Add("Sec-WebSocket-Extensions", "foo")
+
+	offers := parseExtensions(header)
+	require.Equal(t, 3, len(offers))
+	assert.Equal(t, extensionOffer{
+		name:   extPermessageDeflate,
+		params: ExtensionParams{paramClientMaxWindowBits: ""},
+	}, offers[0])
+	assert.Equal(t, extensionOffer{
+		name:   extPermessageDeflate,
+		params: ExtensionParams{paramServerMaxWindowBits: "10"},
+	}, offers[1])
+	assert.Equal(t, "foo", offers[2].name)
+}
+
+func Test_formatExtension(t *testing.T) {
+	s := formatExtension("foo", ExtensionParams{"b": "", "a": "1"})
+	assert.Equal(t, "foo; a=1; b", s)
+}
+
+func Test_acceptExtensions(t *testing.T) {
+	exts := []Extension{
+		newPermessageDeflate(CompressionOptions{}),
+		&xorExtension{},
+	}
+	offers := []extensionOffer{
+		{name: "unknown", params: ExtensionParams{}},
+		{name: "x-xor", params: ExtensionParams{"key": "1"}},
+		{name: "x-xor", params: ExtensionParams{"key": "42"}},
+		{name: extPermessageDeflate, params: ExtensionParams{}},
+		{name: extPermessageDeflate, params: ExtensionParams{}},
+	}
+
+	accepted, resp := acceptExtensions(exts, offers)
+	require.Equal(t, 2, len(accepted))
+	assert.Equal(t, "x-xor", accepted[0].Name())
+	assert.Equal(t, extPermessageDeflate, accepted[1].Name())
+	assert.Equal(t, "x-xor; key=42, permessage-deflate", resp)
+}
+
+func Test_configureExtensions(t *testing.T) {
+	exts := []Extension{&xorExtension{}}
+
+	configured, err := configureExtensions(exts, []extensionOffer{{name: "x-xor"}})
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(configured))
+
+	// not offered
+	_, err = configureExtensions(exts, []extensionOffer{{name: extPermessageDeflate}})
+	assert.Error(t, err)
+
+	// duplicated
+	_, err = configureExtensions(exts, []extensionOffer{{name: "x-xor"}, {name: "x-xor"}})
+	assert.Error(t, err)
+}
+
+func Test_Frame_valid_rsv(t *testing.T) {
+	frm := &Frame{Fin: 1, RSV1: 1, OpCode: OpCodeText}
+	assert.Error(t, frm.valid(0))
+	assert.Error(t, frm.valid(RSV2Bit|RSV3Bit))
+	assert.Nil(t, frm.valid(RSV1Bit))
+}
+
+func Test_Conn_Extensions(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{
+		EnableCompression: true,
+		Extensions:        []Extension{&xorExtension{}},
+	})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL, WithCompression(CompressionOptions{}), WithExtensions(&xorExtension{}))
+	require.Nil(t, err)
+	assert.Equal(t, []string{extPermessageDeflate, "x-xor"}, conn.Extensions())
+
+	// random data could not be compressed, so it would be fragmented.
+	data := make([]byte, 65535*2+10)
+	rand.Read(data)
+	require.Nil(t, conn.SendBinary(bytes.NewReader(data)))
+
+	mt, msg, err := conn.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, BinaryMessage, mt)
+	assert.Equal(t, data, msg)
+}
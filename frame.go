@@ -0,0 +1,183 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+)
+
+// allRSVBits means all reserved bits are allowed, since FrameReader and
+// FrameWriter know nothing about the negotiated extensions.
+const allRSVBits = rsv1Mask | rsv2Mask | rsv3Mask
+
+// FrameReader reads WebSocket frames from any io.Reader, e.g. a recorded
+// stream or a connection which is not upgraded by this package.
+// Frames are validated in common rules of RFC6455 only, reserved bits and
+// masking are not checked, since there is no negotiated extensions and
+// endpoint role.
+type FrameReader struct {
+	rd *bufio.Reader
+
+	// maxFrameSize is the max length of frame payload, 0 means no limit.
+	maxFrameSize int64
+}
+
+// NewFrameReader creates a FrameReader reading from r.
+func NewFrameReader(r io.Reader) *FrameReader {
+	rd, ok := r.(*bufio.Reader)
+	if !ok {
+		rd = bufio.NewReader(r)
+	}
+
+	return &FrameReader{rd: rd}
+}
+
+// SetMaxFrameSize sets the max length of frame payload, ReadFrame returns
+// ErrReadLimit if a frame is over the limit. 0 means no limit.
+func (fr *FrameReader) SetMaxFrameSize(limit int64) {
+	fr.maxFrameSize = limit
+}
+
+// ReadFrame reads next frame, the payload is unmasked, and Mask and
+// MaskingKey are kept as they are received. io.EOF is returned only if no
+// more frame comes.
+func (fr *FrameReader) ReadFrame() (*Frame, error) {
+	p, err := fr.rd.Peek(2)
+	if err != nil {
+		if err == io.EOF && len(p) != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	frm := parseFrameHeader(p)
+	headerLen := frameHeaderLen(frm)
+	if p, err = fr.rd.Peek(headerLen); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	remaining := parseFrameHeaderExt(frm, p)
+	_, _ = fr.rd.Discard(headerLen)
+
+	if err = frm.valid(allRSVBits); err != nil {
+		return nil, err
+	}
+	if fr.maxFrameSize > 0 && remaining > uint64(fr.maxFrameSize) {
+		return nil, ErrReadLimit
+	}
+
+	// the buffer grows as payload comes, the length in header is never
+	// trusted to allocate.
+	size := uint64(fr.rd.Size())
+	if remaining < size {
+		size = remaining
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err = io.CopyN(buf, fr.rd, int64(remaining)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	frm.setPayload(buf.Bytes())
+
+	return frm, nil
+}
+
+// FrameWriter writes WebSocket frames into any io.Writer.
+type FrameWriter struct {
+	w io.Writer
+}
+
+// NewFrameWriter creates a FrameWriter writing into w.
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// WriteFrame writes frm with its Payload, PayloadLen and PayloadExtendLen
+// are calculated from Payload. If Mask is set, the payload is masked with
+// MaskingKey, and a random masking key is generated if it's 0.
+// frm and its payload are not modified.
+func (fw *FrameWriter) WriteFrame(frm *Frame) error {
+	f := *frm
+	if f.Mask == 1 {
+		if f.MaskingKey == 0 {
+			f.genMaskingKey()
+		}
+		f.Payload = append([]byte(nil), f.Payload...)
+	}
+	f.setPayload(f.Payload)
+
+	if err := f.valid(allRSVBits); err != nil {
+		return err
+	}
+
+	_, err := fw.w.Write(encodeFrameTo(&f))
+	return err
+}
+
+// ReadFrame reads next frame from Conn without the message layer. The
+// payload is unmasked but not decoded by extensions. Control frames are
+// handled as ReadMessage does before they are returned, e.g. the ping is
+// replied with pong and the error of closing is returned along with the
+// close frame.
+//
+// The message being read by NextReader or ReadMessage is abandoned, the unread
+// payload of its current frame is discarded, and the rest frames of it would
+// be returned by ReadFrame.
+//
+// The payload of data frame is bounded by the max frame size, or the read limit
+// if it's not set, and 64MB if neither of them is set. ErrReadLimit is returned
+// and the Conn is closed with CloseMessageTooBig if it's over the limit.
+func (c *Conn) ReadFrame() (*Frame, error) {
+	_ = acquire(context.Background(), c.readSem)
+	defer release(c.readSem)
+
+	if c.reader != nil {
+		if err := c.reader.payload.discard(); err != nil {
+			debugErrorf("Conn.ReadFrame failed to discard current frame, err=%v", err)
+			return nil, err
+		}
+		c.reader, c.partial = nil, nil
+	}
+
+	frm, remaining, err := c.readFrameHeader()
+	if err != nil {
+		debugErrorf("Conn.ReadFrame failed to c.readFrameHeader, err=%v", err)
+		return nil, err
+	}
+	if err = c.readRawFramePayload(frm, remaining); err != nil {
+		debugErrorf("Conn.ReadFrame failed to c.readRawFramePayload, err=%v", err)
+		return nil, err
+	}
+
+	err = c.handleControlFrame(frm)
+	return frm, err
+}
+
+// WriteFrame sends frm without the message layer. The payload is not encoded
+// by extensions, RSV bits should be set by caller if it has been encoded.
+// Mask and MaskingKey are set by Conn, and frm is not modified.
+//
+// Caller owns the fragmentation, data frame waits until the message being sent
+// by NextWriter, WriteMessage or SendMessage has been finished, but they must
+// not be used before the fragmented message sent by WriteFrame is finished.
+func (c *Conn) WriteFrame(frm *Frame) error {
+	if frm.OpCode < OpCodeClose {
+		_ = acquire(context.Background(), c.msgSem)
+		defer release(c.msgSem)
+	}
+
+	f := *frm
+	f.Mask, f.MaskingKey = 0, 0
+	c.maskFrame(&f)
+
+	if err := f.valid(c.rsvBits()); err != nil {
+		return err
+	}
+
+	return c.sendFrame(&f)
+}
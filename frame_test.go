@@ -0,0 +1,184 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_FrameReader_FrameWriter(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	fw := NewFrameWriter(buf)
+
+	payload := bytes.Repeat([]byte("a"), 70000)
+	frms := []*Frame{
+		{Fin: 0, OpCode: OpCodeText, Mask: 1, Payload: []byte("hello")},
+		{Fin: 1, OpCode: OpCodePing, Payload: []byte("ping")},
+		{Fin: 1, RSV1: 1, OpCode: OpCodeContinuation, Mask: 1, MaskingKey: 0x01020304, Payload: payload},
+	}
+	for _, frm := range frms {
+		require.Nil(t, fw.WriteFrame(frm))
+	}
+	// frame and payload of caller are not modified
+	assert.Equal(t, uint32(0), frms[0].MaskingKey)
+	assert.Equal(t, bytes.Repeat([]byte("a"), 70000), payload)
+
+	fr := NewFrameReader(buf)
+	for _, want := range frms {
+		frm, err := fr.ReadFrame()
+		require.Nil(t, err)
+		assert.Equal(t, want.Fin, frm.Fin)
+		assert.Equal(t, want.RSV1, frm.RSV1)
+		assert.Equal(t, want.OpCode, frm.OpCode)
+		assert.Equal(t, want.Mask, frm.Mask)
+		assert.Equal(t, want.Payload, frm.Payload)
+	}
+	_, err := fr.ReadFrame()
+	assert.Equal(t, io.EOF, err)
+}
+
+func Test_FrameReader_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{name: "truncated header", data: []byte{0x81}, want: io.ErrUnexpectedEOF},
+		{name: "truncated payload", data: []byte{0x81, 0x05, 'a'}, want: io.ErrUnexpectedEOF},
+		{name: "reserved opcode", data: []byte{0x83, 0x00}, want: ErrReservedOpCode},
+		{name: "non minimal length", data: []byte{0x82, 0x7E, 0x00, 0x01, 'a'}, want: ErrNonMinimalLength},
+		{name: "over limit", data: []byte{0x82, 0x7E, 0x01, 0x00}, want: ErrReadLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fr := NewFrameReader(bytes.NewReader(tt.data))
+			fr.SetMaxFrameSize(255)
+			_, err := fr.ReadFrame()
+			assert.Equal(t, tt.want, err)
+		})
+	}
+}
+
+func Test_FrameWriter_invalid(t *testing.T) {
+	fw := NewFrameWriter(bytes.NewBuffer(nil))
+	err := fw.WriteFrame(&Frame{Fin: 0, OpCode: OpCodePing})
+	assert.Equal(t, ErrFragmentedControlFrame, err)
+	err = fw.WriteFrame(&Frame{Fin: 1, OpCode: OpCodeClose, Payload: make([]byte, 126)})
+	assert.Equal(t, ErrControlFrameTooBig, err)
+}
+
+func Test_Conn_ReadFrame_WriteFrame(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	// mock client send fragments frame by frame, and a ping between them
+	conn.isServer = false
+	frms := []*Frame{
+		{Fin: 0, OpCode: OpCodeBinary, Payload: []byte("hello ")},
+		{Fin: 1, OpCode: OpCodePing, Payload: []byte("ping")},
+		{Fin: 1, OpCode: OpCodeContinuation, Payload: []byte("world")},
+	}
+	for _, frm := range frms {
+		require.Nil(t, conn.WriteFrame(frm))
+	}
+	assert.Equal(t, uint16(0), frms[0].Mask)
+
+	// reserved bit is not allowed without extensions
+	err := conn.WriteFrame(&Frame{Fin: 1, RSV1: 1, OpCode: OpCodeText})
+	assert.Error(t, err)
+
+	conn.isServer = true
+	var pings []string
+	conn.SetPingHandler(func(appData string) error {
+		pings = append(pings, appData)
+		return nil
+	})
+	for _, want := range frms {
+		frm, err := conn.ReadFrame()
+		require.Nil(t, err)
+		assert.Equal(t, want.Fin, frm.Fin)
+		assert.Equal(t, want.OpCode, frm.OpCode)
+		assert.Equal(t, uint16(1), frm.Mask)
+		assert.Equal(t, want.Payload, frm.Payload)
+	}
+	assert.Equal(t, []string{"ping"}, pings)
+}
+
+func Test_FrameReader_hugeLength(t *testing.T) {
+	// 1<<62 is a valid length, but nothing follows the header
+	data := []byte{0x82, 0x7F, 0x40, 0, 0, 0, 0, 0, 0, 0, 'a'}
+	_, err := NewFrameReader(bytes.NewReader(data)).ReadFrame()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func Test_Conn_ReadFrame_limit(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	conn.isServer = false
+	require.Nil(t, conn.WriteFrame(&Frame{Fin: 1, OpCode: OpCodeBinary, Payload: make([]byte, 1000)}))
+
+	conn.isServer = true
+	conn.SetReadLimit(100)
+	_, err := conn.ReadFrame()
+	assert.Equal(t, ErrReadLimit, err)
+}
+
+func Test_Conn_ReadFrame_afterNextReader(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	conn.isServer = false
+	require.Nil(t, conn.WriteFrame(&Frame{Fin: 0, OpCode: OpCodeText, Payload: []byte("hello world")}))
+	require.Nil(t, conn.WriteFrame(&Frame{Fin: 1, OpCode: OpCodeContinuation, Payload: []byte("!")}))
+
+	// the unread payload of current frame is discarded
+	conn.isServer = true
+	_, r, err := conn.NextReader()
+	require.Nil(t, err)
+	p := make([]byte, 5)
+	_, err = io.ReadFull(r, p)
+	require.Nil(t, err)
+	assert.Equal(t, "hello", string(p))
+
+	frm, err := conn.ReadFrame()
+	require.Nil(t, err)
+	assert.Equal(t, OpCodeContinuation, frm.OpCode)
+	assert.Equal(t, []byte("!"), frm.Payload)
+	assert.Equal(t, Connected, conn.State())
+}
+
+func Test_Conn_WriteFrame_waitMessage(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+	conn.isServer = false
+
+	// data frame waits until the message being sent is finished
+	w, err := conn.NextWriter(TextMessage)
+	require.Nil(t, err)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- conn.WriteFrame(&Frame{Fin: 1, OpCode: OpCodeBinary, Payload: []byte("frame")})
+	}()
+	select {
+	case <-sent:
+		t.Fatal("WriteFrame should wait for the message writer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, _ = w.Write([]byte("message"))
+	require.Nil(t, w.Close())
+	require.Nil(t, <-sent)
+
+	conn.isServer = true
+	_, msg, err := conn.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "message", string(msg))
+	_, msg, err = conn.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "frame", string(msg))
+}
@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrKeepaliveTimeout is returned by read methods after the Conn has
+	// been closed by keepalive, since nothing comes from peer in time.
+	ErrKeepaliveTimeout = errors.New("websocket: keepalive timeout, peer is not responding")
+)
+
+// KeepaliveOptions configures keepalive of Conn, ping is sent if nothing has
+// been received from peer for Interval, and the Conn is closed with
+// CloseGoingAway if still nothing comes within Timeout after ping.
+//
+// NOTICE: pong is handled by read methods, so the Conn MUST be read.
+type KeepaliveOptions struct {
+	// Interval of idle time before sending ping, 0 disables keepalive.
+	Interval time.Duration
+	// Timeout of waiting for any frame after ping, Interval is used if 0.
+	Timeout time.Duration
+}
+
+func (opt KeepaliveOptions) timeout() time.Duration {
+	if opt.Timeout <= 0 {
+		return opt.Interval
+	}
+	return opt.Timeout
+}
+
+// startKeepalive starts keepalive goroutine if it's enabled, it exits once
+// the Conn is closed.
+func (c *Conn) startKeepalive(opt KeepaliveOptions) {
+	if opt.Interval <= 0 {
+		return
+	}
+
+	c.touch()
+	go c.keepalive(opt)
+}
+
+func (c *Conn) keepalive(opt KeepaliveOptions) {
+	var (
+		timer = time.NewTimer(opt.Interval)
+		// pingAt is the time of ping which is waiting for response
+		pingAt time.Time
+	)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-c.done:
+			return
+		}
+
+		now, last := time.Now(), c.lastActive()
+		if !pingAt.IsZero() {
+			if last.Before(pingAt) {
+				c.keepaliveTimeout(opt.timeout())
+				return
+			}
+			pingAt = time.Time{}
+		}
+
+		if idle := now.Sub(last); idle < opt.Interval {
+			timer.Reset(opt.Interval - idle)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), opt.timeout())
+		err := c.PingContext(ctx)
+		cancel()
+		if err != nil {
+			debugErrorf("Conn.keepalive failed to ping, err=%v", err)
+			if err == context.DeadlineExceeded {
+				c.keepaliveTimeout(opt.timeout())
+			}
+			return
+		}
+		pingAt = now
+		timer.Reset(opt.timeout())
+	}
+}
+
+// keepaliveTimeout closes the Conn, and read methods would report
+// ErrKeepaliveTimeout since now. Peer may not read either, so sending close
+// frame is bounded by timeout.
+func (c *Conn) keepaliveTimeout(timeout time.Duration) {
+	logger.Debugf("Conn.keepalive timeout, closing")
+	c.stateMu.Lock()
+	c.readErr = ErrKeepaliveTimeout
+	c.stateMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := c.closeContext(ctx, CloseGoingAway, ErrKeepaliveTimeout.Error()); err != nil {
+		debugErrorf("Conn.keepaliveTimeout failed to close, err=%v", err)
+	}
+}
+
+// touch marks that something has been received from peer.
+func (c *Conn) touch() {
+	atomic.StoreInt64(&c.lastActiveNano, time.Now().UnixNano())
+}
+
+// lastActive returns the last time when something has been received from peer.
+func (c *Conn) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActiveNano))
+}
@@ -0,0 +1,53 @@
+package websocket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Conn_Keepalive(t *testing.T) {
+	// server keeps alive, and it's reading so pong would be handled
+	state := make(chan ConnState, 1)
+	srv, wsURL := newTestServer(Upgrader{
+		Keepalive: KeepaliveOptions{Interval: 20 * time.Millisecond, Timeout: 50 * time.Millisecond},
+	}, func(conn *Conn) {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		_, _, _ = conn.ReadMessageContext(ctx)
+		state <- conn.State()
+		conn.Close()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	// client replies pong while reading
+	go func() {
+		_, _, _ = conn.ReadMessage()
+	}()
+	assert.Equal(t, Connected, <-state)
+}
+
+func Test_Conn_Keepalive_timeout(t *testing.T) {
+	// server never reads, so that ping would not be replied
+	done := make(chan struct{})
+	defer close(done)
+	srv, wsURL := newTestServer(Upgrader{}, func(conn *Conn) {
+		<-done
+		conn.Close()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(wsURL, WithKeepalive(KeepaliveOptions{Interval: 20 * time.Millisecond}))
+	require.Nil(t, err)
+
+	_, _, err = conn.ReadMessage()
+	assert.Equal(t, ErrKeepaliveTimeout, err)
+	assert.Equal(t, Closed, conn.State())
+}
@@ -0,0 +1,52 @@
+package websocket
+
+import "unsafe"
+
+// maskWordSize is the number of bytes masked at a time by maskBytes.
+const maskWordSize = 8
+
+// maskBytes masks p with masks starting at pos of the masking key, then returns
+// the position for next part, so that payload could be masked part by part.
+//
+// p is masked byte by byte until it's aligned to 8 bytes, then 8 bytes are
+// masked at a time with the masking key repeated in a word, and the tail is
+// masked byte by byte. It works in place without allocation.
+func maskBytes(masks [4]byte, pos int, p []byte) int {
+	// small p is not worth aligning
+	if len(p) < 2*maskWordSize {
+		return maskBytesByByte(masks, pos, p)
+	}
+
+	// prologue, mask byte by byte to the word boundary
+	if n := int(uintptr(unsafe.Pointer(&p[0])) % maskWordSize); n != 0 {
+		n = maskWordSize - n
+		pos = maskBytesByByte(masks, pos, p[:n])
+		p = p[n:]
+	}
+
+	// the masking key rotated by pos, repeated in a word. Both the key and
+	// payload are accessed in native byte order, so it works on any endian.
+	var key uint64
+	keyBytes := (*[maskWordSize]byte)(unsafe.Pointer(&key))
+	for i := range keyBytes {
+		keyBytes[i] = masks[(pos+i)&3]
+	}
+
+	// mask a word at a time, pos is not changed since word size is a
+	// multiple of 4.
+	n := len(p) / maskWordSize * maskWordSize
+	for i := 0; i < n; i += maskWordSize {
+		*(*uint64)(unsafe.Pointer(&p[i])) ^= key
+	}
+
+	// epilogue, mask the tail byte by byte
+	return maskBytesByByte(masks, pos, p[n:])
+}
+
+// maskBytesByByte masks p byte by byte, it's the same as maskBytes.
+func maskBytesByByte(masks [4]byte, pos int, p []byte) int {
+	for i, v := range p {
+		p[i] = v ^ masks[(pos+i)&3]
+	}
+	return (pos + len(p)) & 3
+}
@@ -0,0 +1,30 @@
+//go:build go1.18
+// +build go1.18
+
+package websocket
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func Fuzz_maskBytes(f *testing.F) {
+	f.Add(uint32(0x9acb0442), 0, 0, []byte("hello"))
+	f.Add(uint32(0x01020304), 3, 5, bytes.Repeat([]byte("websocket"), 10))
+	f.Add(uint32(0x01020304), 1, math.MinInt64, []byte("websocket"))
+
+	f.Fuzz(func(t *testing.T, key uint32, pos int, offset int, p []byte) {
+		masks := genMasks(key)
+		pos &= 3
+		offset = int(uint(offset) % uint(len(p)+1))
+
+		want := append([]byte(nil), p...)
+		wantPos := maskBytesByByte(masks, pos, want[offset:])
+		got := append([]byte(nil), p...)
+		gotPos := maskBytes(masks, pos, got[offset:])
+		if wantPos != gotPos || !bytes.Equal(want, got) {
+			t.Fatalf("maskBytes differs from maskBytesByByte, pos=%d offset=%d", pos, offset)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_maskBytes_equivalence(t *testing.T) {
+	masks := [4]byte{0x9a, 0xcb, 0x04, 0x42}
+	data := make([]byte, 128)
+	rand.Read(data)
+
+	// every alignment of p, key offset and length around word boundaries
+	for offset := 0; offset < 2*maskWordSize; offset++ {
+		for pos := 0; pos < 4; pos++ {
+			for size := 0; size <= 64; size++ {
+				want := append([]byte(nil), data...)
+				wantPos := maskBytesByByte(masks, pos, want[offset:offset+size])
+
+				got := append([]byte(nil), data...)
+				gotPos := maskBytes(masks, pos, got[offset:offset+size])
+
+				assert.Equal(t, wantPos, gotPos, "offset=%d pos=%d size=%d", offset, pos, size)
+				if !bytes.Equal(want, got) {
+					t.Fatalf("offset=%d pos=%d size=%d got different result", offset, pos, size)
+				}
+			}
+		}
+	}
+}
+
+func Test_maskBytes_quick(t *testing.T) {
+	f := func(masks [4]byte, pos uint8, offset uint8, p []byte) bool {
+		start := int(offset) % (len(p) + 1)
+		want := append([]byte(nil), p...)
+		wantPos := maskBytesByByte(masks, int(pos)&3, want[start:])
+		got := append([]byte(nil), p...)
+		gotPos := maskBytes(masks, int(pos)&3, got[start:])
+		return wantPos == gotPos && bytes.Equal(want, got)
+	}
+
+	assert.Nil(t, quick.Check(f, &quick.Config{MaxCount: 10000}))
+}
+
+func Test_maskBytes_stream(t *testing.T) {
+	masks := genMasks(0x01020304)
+	data := make([]byte, 4096)
+	rand.Read(data)
+	want := append([]byte(nil), data...)
+	maskBytesByByte(masks, 0, want)
+
+	// mask in chunks of random size, the key offset is rotated across chunks
+	pos, p := 0, data
+	for len(p) != 0 {
+		n := rand.Intn(100) + 1
+		if n > len(p) {
+			n = len(p)
+		}
+		pos = maskBytes(masks, pos, p[:n])
+		p = p[n:]
+	}
+	assert.Equal(t, want, data)
+}
+
+func Test_maskBytes_allocs(t *testing.T) {
+	masks := genMasks(0x01020304)
+	p := make([]byte, 1024)
+	allocs := testing.AllocsPerRun(100, func() {
+		maskBytes(masks, 1, p[3:])
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+func benchmarkMask(b *testing.B, fn func(masks [4]byte, pos int, p []byte) int) {
+	masks := genMasks(0x9acb0442)
+	for _, size := range []int{8, 125, 1024, 65535} {
+		for _, offset := range []int{0, 1} {
+			b.Run(fmt.Sprintf("size=%d/offset=%d", size, offset), func(b *testing.B) {
+				p := make([]byte, size+offset)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					fn(masks, 0, p[offset:])
+				}
+			})
+		}
+	}
+}
+
+func Benchmark_maskBytes(b *testing.B) {
+	benchmarkMask(b, maskBytes)
+}
+
+func Benchmark_maskBytesByByte(b *testing.B) {
+	benchmarkMask(b, maskBytesByByte)
+}
@@ -0,0 +1,462 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	// ErrWriterClosed .
+	ErrWriterClosed = errors.New("websocket: message writer closed")
+	// ErrReadLimit means the message or frame from peer is over the read limit,
+	// and the Conn has been closed with CloseMessageTooBig.
+	ErrReadLimit = errors.New("websocket: read limit exceeded")
+	// ErrMessageInterrupted means reading a message which is decoded as a
+	// stream, e.g. compressed by permessage-deflate, has timed out in the
+	// middle, the rest of it could not be read, and the Conn has been closed.
+	ErrMessageInterrupted = errors.New("websocket: message decoding interrupted")
+)
+
+// messageReader reads payload of one message across continuation frames.
+// Payload is read from frames by payloadReader, and it's decoded on the fly
+// if the only negotiated extension decodes messages as a stream, e.g.
+// permessage-deflate, so that large message is never buffered in whole.
+type messageReader struct {
+	c *Conn
+
+	payload *payloadReader
+	// decoder yields the decoded payload, nil means payload is not decoded
+	// as a stream.
+	decoder io.Reader
+	// decodedSize is the length of payload which has been decoded by
+	// decoder, it's checked with Conn.readLimit.
+	decodedSize uint64
+
+	// utf8 validates payload of text message, nil means no validation.
+	utf8 *utf8Validator
+
+	// err is sticky except timeout, io.EOF means the whole message has been
+	// read. Timeout is sticky as ErrMessageInterrupted while decoding, since
+	// the decoder could not be resumed, and the Conn is closed then.
+	err error
+}
+
+// newMessageReader creates messageReader of the message whose first frame is
+// frm, read limit is checked before reading the payload.
+func newMessageReader(c *Conn, frm *Frame, remaining uint64) (*messageReader, error) {
+	sd := c.streamDecoder()
+	r := &messageReader{
+		c:       c,
+		payload: &payloadReader{c: c, stream: sd != nil},
+	}
+	if frm.OpCode == OpCodeText && !c.skipUTF8Validation {
+		r.utf8 = new(utf8Validator)
+	}
+	if err := r.payload.beginFrame(frm, remaining); err != nil {
+		return nil, err
+	}
+
+	if sd != nil {
+		decoder, err := sd.decodeStream(frm, r.payload)
+		if err != nil {
+			debugErrorf("newMessageReader failed to sd.decodeStream, err=%v", err)
+			_ = c.close(CloseInternalServerErr)
+			return nil, err
+		}
+		r.decoder = decoder
+	}
+	return r, nil
+}
+
+// Read reads payload of the message, it holds Conn.readSem while reading.
+func (r *messageReader) Read(p []byte) (n int, err error) {
+	_ = acquire(context.Background(), r.c.readSem)
+	defer release(r.c.readSem)
+
+	return r.read(p)
+}
+
+// unlockedReader reads messageReader without taking Conn.readSem, it's used
+// by read methods which have taken it.
+type unlockedReader struct {
+	r *messageReader
+}
+
+func (u unlockedReader) Read(p []byte) (int, error) {
+	return u.r.read(p)
+}
+
+func (r *messageReader) read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if r.decoder != nil {
+		n, err = r.readDecoded(p)
+	} else {
+		n, err = r.payload.read(p)
+	}
+	if n != 0 || err == io.EOF {
+		if verr := r.validateUTF8(p[:n], err == io.EOF); verr != nil {
+			return 0, verr
+		}
+	}
+	if err != nil && !isTimeout(err) {
+		r.err = err
+	}
+	return n, err
+}
+
+// readDecoded reads from decoder, the decoded payload is checked with read
+// limit as it comes.
+func (r *messageReader) readDecoded(p []byte) (int, error) {
+	n, err := r.decoder.Read(p)
+	r.decodedSize += uint64(n)
+	if lerr := r.c.checkReadLimit(r.decodedSize); lerr != nil {
+		return 0, lerr
+	}
+
+	switch {
+	case err == nil:
+	case err == io.EOF:
+		// payload after the end of decoded stream is discarded
+		if _, derr := io.Copy(ioutil.Discard, r.payload); derr != nil {
+			return 0, derr
+		}
+	case isTimeout(err):
+		// reading payload timed out, neither the rest of message nor the
+		// messages after it could be decoded, so the Conn is failed.
+		r.err = ErrMessageInterrupted
+		_ = r.c.close(CloseInternalServerErr)
+	case r.payload.err != nil:
+		// reading payload failed, err is returned by decoder as it is
+	default:
+		debugErrorf("messageReader.readDecoded failed to decode, err=%v", err)
+		_ = r.c.close(CloseInvalidFramePayloadData)
+		err = &CloseError{Code: CloseInvalidFramePayloadData, Text: err.Error()}
+	}
+	return n, err
+}
+
+// validateUTF8 validates p of text message, final means the end of message.
+// The Conn is closed with CloseInvalidFramePayloadData if it's invalid UTF-8.
+func (r *messageReader) validateUTF8(p []byte, final bool) error {
+	if r.utf8 == nil {
+		return nil
+	}
+	if r.utf8.write(p) && (!final || r.utf8.done()) {
+		return nil
+	}
+
+	r.err = ErrInvalidUTF8
+	_ = r.c.close(CloseInvalidFramePayloadData)
+	return r.err
+}
+
+// payloadReader reads payload of one message from frames. If extensions are
+// negotiated and they don't decode as a stream, payload is collected frame by
+// frame so that extensions could decode the whole frame, otherwise payload
+// is read from connection and unmasked on the fly.
+type payloadReader struct {
+	c *Conn
+
+	// stream marks the payload is decoded as a stream by messageReader, so
+	// that frames are not decoded by extensions.
+	stream bool
+
+	// frm is the header of current frame
+	frm *Frame
+	// remaining is the length of payload of frm which has not been read
+	remaining uint64
+	masks     [4]byte
+	maskPos   int
+	// buf collects the frame to be decoded by extensions, it grows as payload
+	// comes. nil means frames are not decoded by extensions or the frame has
+	// been decoded.
+	buf *bytes.Buffer
+	// decoded is the payload of frm which has been decoded by extensions
+	decoded []byte
+
+	// size and decodedSize are the length of payload of the message which
+	// has been received and decoded, they are checked with Conn.readLimit.
+	size        uint64
+	decodedSize uint64
+
+	// err is sticky except timeout, io.EOF means the whole payload has been read
+	err error
+}
+
+// beginFrame prepares to read payload of frm, read limit is checked before
+// reading the payload.
+func (r *payloadReader) beginFrame(frm *Frame, remaining uint64) error {
+	if r.stream && frm.OpCode == OpCodeContinuation && frm.RSV1 == 1 {
+		// only the first frame of message carries the reserved bit of the
+		// extension, e.g. RFC7692 Section-6.1
+		_ = r.c.close(CloseProtocolError)
+		return newInvalidFrameError("RSV1 set on continuation frame")
+	}
+
+	r.size += remaining
+	if err := r.c.checkReadLimit(r.size); err != nil {
+		return err
+	}
+
+	r.frm = frm
+	r.remaining = remaining
+	r.masks = genMasks(frm.MaskingKey)
+	r.maskPos = 0
+	if len(r.c.extensions) != 0 && !r.stream {
+		buf, err := r.c.newFrameBuffer(frm, remaining)
+		if err != nil {
+			return err
+		}
+		r.buf = buf
+	}
+	return nil
+}
+
+// Read reads payload without taking Conn.readSem, it's read by the decoder of
+// messageReader.
+func (r *payloadReader) Read(p []byte) (int, error) {
+	return r.read(p)
+}
+
+func (r *payloadReader) read(p []byte) (n int, err error) {
+	for r.err == nil {
+		if len(r.decoded) != 0 {
+			n = copy(p, r.decoded)
+			r.decoded = r.decoded[n:]
+			return n, nil
+		}
+
+		if r.buf != nil {
+			if err = r.collectFrame(); err != nil {
+				return 0, r.fail(err)
+			}
+			continue
+		}
+
+		if r.remaining != 0 {
+			if uint64(len(p)) > r.remaining {
+				p = p[:r.remaining]
+			}
+			n, err = r.c.bufRD.Read(p)
+			r.remaining -= uint64(n)
+			if n != 0 {
+				r.c.touch()
+			}
+			if r.frm.Mask == 1 {
+				r.maskPos = maskBytes(r.masks, r.maskPos, p[:n])
+			}
+			if err != nil {
+				return n, r.fail(err)
+			}
+			return n, nil
+		}
+
+		if r.frm.isFinal() {
+			r.err = io.EOF
+			break
+		}
+
+		// read next frame of the message
+		frm, remaining, err := r.c.readFrameHeader()
+		if err != nil {
+			debugErrorf("payloadReader.read failed to c.readFrameHeader, err=%v", err)
+			return 0, r.fail(err)
+		}
+		switch frm.OpCode {
+		case OpCodeContinuation:
+			r.err = r.beginFrame(frm, remaining)
+		case OpCodeText, OpCodeBinary:
+			r.err = ErrContinuationExpected
+			_ = r.c.close(CloseProtocolError)
+		default:
+			// control frames could be sent between fragments
+			if r.err = r.c.readFramePayload(frm, remaining); r.err == nil {
+				r.err = r.c.handleControlFrame(frm)
+			}
+		}
+	}
+
+	return 0, r.err
+}
+
+// collectFrame reads the remaining payload of frame into r.buf, then the
+// frame is decoded by extensions.
+func (r *payloadReader) collectFrame() error {
+	if r.remaining != 0 {
+		n, err := io.CopyN(r.buf, connReader{r.c}, int64(r.remaining))
+		r.remaining -= uint64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	frm := r.frm
+	frm.setPayload(r.buf.Bytes())
+	r.buf = nil
+
+	// extensions may inflate the payload, it's bounded by the rest of read
+	// limit, so that it's never decoded in whole if it's over the limit.
+	limit := int64(-1)
+	if r.c.readLimit > 0 {
+		limit = r.c.readLimit - int64(r.decodedSize)
+	}
+	r.c.limitDecode(limit)
+	if err := r.c.decodeReadFrame(frm); err != nil {
+		return err
+	}
+
+	r.decodedSize += uint64(len(frm.Payload))
+	if err := r.c.checkReadLimit(r.decodedSize); err != nil {
+		return err
+	}
+	r.decoded = frm.Payload
+	return nil
+}
+
+// discard skips the unread payload of current frame, so that the next frame
+// could be read from Conn.
+func (r *payloadReader) discard() error {
+	if r.remaining == 0 {
+		return nil
+	}
+
+	n, err := io.CopyN(ioutil.Discard, connReader{r.c}, int64(r.remaining))
+	r.remaining -= uint64(n)
+	if err != nil {
+		return r.fail(err)
+	}
+	return nil
+}
+
+// fail records err as sticky unless it's a timeout, since nothing has been
+// consumed partially, reading could be resumed after timeout.
+func (r *payloadReader) fail(err error) error {
+	if err == io.EOF {
+		err = ErrUnexpectedEOF
+	}
+	err = r.c.readError(err)
+	if !isTimeout(err) {
+		r.err = err
+	}
+	return err
+}
+
+// messageWriter writes payload of one message, it sends a frame once the
+// buffer is full and more data comes, the final frame is sent by Close.
+// Conn.msgSem is held by messageWriter until Close.
+type messageWriter struct {
+	c *Conn
+
+	// opcode of next frame, it becomes continuation after the first frame
+	opcode OpCode
+	// buf is the payload of next frame, at most size bytes
+	buf []byte
+	// size is the max payload size of each frame, 0 means the whole message
+	// is sent in one frame.
+	size int
+
+	// err is sticky, ErrWriterClosed means Close has been called
+	err error
+	// closed marks Conn.msgSem has been released
+	closed bool
+}
+
+func newMessageWriter(c *Conn, opcode OpCode) *messageWriter {
+	w := &messageWriter{
+		c:      c,
+		opcode: opcode,
+		size:   c.fragmentSize(),
+	}
+	if w.size > 0 {
+		w.buf = make([]byte, 0, w.size)
+	}
+	return w
+}
+
+func (w *messageWriter) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.size <= 0 {
+		// never fragment, buffer the whole message
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+
+	for len(p) != 0 {
+		// flush only if more data comes, so the final frame is never empty
+		// unless the message is empty.
+		if len(w.buf) == cap(w.buf) {
+			if err = w.flushFrame(false); err != nil {
+				return n, err
+			}
+		}
+
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		p = p[m:]
+	}
+
+	return n, nil
+}
+
+// Close sends the final frame of the message, and releases Conn.msgSem.
+func (w *messageWriter) Close() (err error) {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+	defer release(w.c.msgSem)
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if err = w.flushFrame(true); err != nil {
+		return err
+	}
+	w.err = ErrWriterClosed
+	return nil
+}
+
+// abort drops the message without sending the final frame, and releases
+// Conn.msgSem. If some frames of it have been sent, the Conn is failed with
+// CloseInternalServerErr, since the peer could never get a complete message.
+func (w *messageWriter) abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	defer release(w.c.msgSem)
+
+	if w.err == nil && w.opcode == OpCodeContinuation {
+		_ = w.c.close(CloseInternalServerErr)
+	}
+	w.err = ErrWriterClosed
+}
+
+// flushFrame sends buffered payload as a frame.
+func (w *messageWriter) flushFrame(final bool) (err error) {
+	frm := constructFrame(w.opcode, final, true)
+	frm.Payload = w.buf
+	if err = w.c.encodeDataFrame(frm); err == nil {
+		err = w.c.sendFrame(frm)
+	}
+	if err != nil {
+		debugErrorf("messageWriter.flushFrame failed to send frame, err=%v", err)
+		w.err = err
+		return err
+	}
+
+	w.buf = w.buf[:0]
+	w.opcode = OpCodeContinuation
+	return nil
+}
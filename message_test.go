@@ -0,0 +1,391 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Conn_NextReader(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	// mock client send, payload would be masked and fragmented
+	data := make([]byte, 65535*3+100)
+	rand.Read(data)
+	conn.isServer = false
+	require.Nil(t, conn.sendDataFrame(data, OpCodeBinary))
+
+	// mock server read byte by byte
+	conn.isServer = true
+	mt, r, err := conn.NextReader()
+	require.Nil(t, err)
+	assert.Equal(t, BinaryMessage, mt)
+
+	h := sha256.New()
+	n, err := io.Copy(h, iotest.OneByteReader(r))
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	want := sha256.Sum256(data)
+	assert.Equal(t, want[:], h.Sum(nil))
+}
+
+func Test_Conn_NextReader_discard(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	// mock client send two message with a ping between them
+	conn.isServer = false
+	require.Nil(t, conn.sendDataFrame(bytes.Repeat([]byte("a"), 65535*2), OpCodeText))
+	require.Nil(t, conn.Ping())
+	require.Nil(t, conn.sendDataFrame([]byte("second"), OpCodeText))
+
+	conn.isServer = true
+	mt, r, err := conn.NextReader()
+	require.Nil(t, err)
+	assert.Equal(t, TextMessage, mt)
+	p := make([]byte, 10)
+	_, err = io.ReadFull(r, p)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("aaaaaaaaaa"), p)
+
+	// the unread part of first message is discarded, and ping is handled.
+	mt, r, err = conn.NextReader()
+	require.Nil(t, err)
+	assert.Equal(t, TextMessage, mt)
+	msg, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("second"), msg)
+}
+
+func Test_Conn_NextReader_unexpectedContinuation(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+	frms := mockFragmentFrames(false)
+
+	// send the continuation frame only
+	require.Nil(t, conn.sendFrame(frms[1]))
+	_, _, err := conn.NextReader()
+	assert.Error(t, err)
+}
+
+func Test_Conn_NextWriter(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	// mock client send in small pieces
+	conn.isServer = false
+	data := make([]byte, 65535*2+10)
+	rand.Read(data)
+	w, err := conn.NextWriter(BinaryMessage)
+	require.Nil(t, err)
+	for p := data; len(p) != 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		_, err = w.Write(p[:n])
+		require.Nil(t, err)
+		p = p[n:]
+	}
+	require.Nil(t, w.Close())
+	assert.Equal(t, ErrWriterClosed, w.Close())
+	_, err = w.Write([]byte("more"))
+	assert.Equal(t, ErrWriterClosed, err)
+
+	// mock server read frame by frame
+	conn.isServer = true
+	wants := []struct {
+		fin    uint16
+		opcode OpCode
+		size   int
+	}{
+		{fin: 0, opcode: OpCodeBinary, size: 65535},
+		{fin: 0, opcode: OpCodeContinuation, size: 65535},
+		{fin: 1, opcode: OpCodeContinuation, size: 10},
+	}
+	got := make([]byte, 0, len(data))
+	for _, want := range wants {
+		frm, err := conn.readFrame()
+		require.Nil(t, err)
+		assert.Equal(t, want.fin, frm.Fin)
+		assert.Equal(t, want.opcode, frm.OpCode)
+		assert.Equal(t, want.size, len(frm.Payload))
+		got = append(got, frm.Payload...)
+	}
+	assert.Equal(t, data, got)
+}
+
+func Test_Conn_NextWriter_blocking(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	w, err := conn.NextWriter(TextMessage)
+	require.Nil(t, err)
+	_, err = w.Write([]byte("first"))
+	require.Nil(t, err)
+
+	// the next message waits until previous writer is closed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w2, err := conn.NextWriter(TextMessage)
+		require.Nil(t, err)
+		_, err = w2.Write([]byte("second"))
+		require.Nil(t, err)
+		require.Nil(t, w2.Close())
+	}()
+
+	// ping could be sent while message is writing
+	require.Nil(t, conn.Ping())
+	_, err = w.Write([]byte(" message"))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	<-done
+
+	_, err = conn.NextWriter(PingMessage)
+	assert.Error(t, err)
+
+	conn.isServer = false
+	for _, want := range []string{"first message", "second"} {
+		mt, msg, err := conn.ReadMessage()
+		require.Nil(t, err)
+		assert.Equal(t, TextMessage, mt)
+		assert.Equal(t, want, string(msg))
+	}
+}
+
+func Test_Conn_ReadMessage_interleavedControl(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	// mock client send control frames between fragments
+	conn.isServer = false
+	sendFragment := func(opcode OpCode, final bool, payload string) {
+		frm := constructFrame(opcode, final, true)
+		frm.Payload = []byte(payload)
+		require.Nil(t, conn.encodeDataFrame(frm))
+		require.Nil(t, conn.sendFrame(frm))
+	}
+	sendFragment(OpCodeText, false, "hello ")
+	require.Nil(t, conn.sendControlFrame(OpCodePing, []byte("p1")))
+	require.Nil(t, conn.sendControlFrame(OpCodePong, []byte("p2")))
+	sendFragment(OpCodeContinuation, true, "world")
+	sendFragment(OpCodeText, false, "closed ")
+	require.Nil(t, conn.sendControlFrame(OpCodeClose, closePayload(CloseGoingAway, "bye")))
+
+	// server dispatches control frames to handlers, and they are not
+	// appended to message.
+	conn.isServer = true
+	var pings, pongs []string
+	conn.SetPingHandler(func(appData string) error {
+		pings = append(pings, appData)
+		return nil
+	})
+	conn.SetPongHandler(func(appData string) {
+		pongs = append(pongs, appData)
+	})
+	closeCode := 0
+	conn.SetCloseHandler(func(code int, text string) error {
+		closeCode = code
+		return nil
+	})
+
+	mt, msg, err := conn.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, TextMessage, mt)
+	assert.Equal(t, "hello world", string(msg))
+	assert.Equal(t, []string{"p1"}, pings)
+	assert.Equal(t, []string{"p2"}, pongs)
+
+	_, _, err = conn.ReadMessage()
+	assert.Equal(t, &CloseError{Code: CloseGoingAway, Text: "bye"}, err)
+	assert.Equal(t, CloseGoingAway, closeCode)
+}
+
+func Test_Conn_NextWriter_interleavedPing(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	// the first fragment is sent once more data comes, then ping is sent
+	// before the final fragment.
+	conn.isServer = false
+	w, err := conn.NextWriter(BinaryMessage)
+	require.Nil(t, err)
+	_, err = w.Write(make([]byte, 65535+10))
+	require.Nil(t, err)
+	require.Nil(t, conn.Ping())
+	require.Nil(t, w.Close())
+
+	conn.isServer = true
+	wants := []struct {
+		fin    uint16
+		opcode OpCode
+	}{
+		{fin: 0, opcode: OpCodeBinary},
+		{fin: 1, opcode: OpCodePing},
+		{fin: 1, opcode: OpCodeContinuation},
+	}
+	for _, want := range wants {
+		frm, err := conn.readFrame()
+		require.Nil(t, err)
+		assert.Equal(t, want.fin, frm.Fin)
+		assert.Equal(t, want.opcode, frm.OpCode)
+	}
+}
+
+func Test_Conn_ReadMessage_invalidUTF8(t *testing.T) {
+	sendText := func(conn *Conn, fragments ...string) {
+		conn.isServer = false
+		for i, fragment := range fragments {
+			opcode := OpCodeContinuation
+			if i == 0 {
+				opcode = OpCodeText
+			}
+			frm := constructFrame(opcode, i == len(fragments)-1, true)
+			frm.Payload = []byte(fragment)
+			require.Nil(t, conn.encodeDataFrame(frm))
+			require.Nil(t, conn.sendFrame(frm))
+		}
+		conn.isServer = true
+	}
+
+	// rune is split across fragments, and read byte by byte
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+	sendText(conn, "世", "\xe7", "\x95\x8c")
+	_, r, err := conn.NextReader()
+	require.Nil(t, err)
+	msg, err := ioutil.ReadAll(iotest.OneByteReader(r))
+	require.Nil(t, err)
+	assert.Equal(t, "世界", string(msg))
+
+	// invalid, or incomplete at the end of message
+	for _, fragments := range [][]string{{"ab\xff"}, {"ab", "\xe7\x95"}} {
+		buf = bytes.NewBuffer(nil)
+		conn = mockConn(buf)
+		sendText(conn, fragments...)
+		_, _, err = conn.ReadMessage()
+		assert.Equal(t, ErrInvalidUTF8, err)
+		assert.Equal(t, Closed, conn.State())
+	}
+
+	// skip validation
+	buf = bytes.NewBuffer(nil)
+	conn = mockConn(buf)
+	conn.skipUTF8Validation = true
+	sendText(conn, "ab\xff")
+	_, msg, err = conn.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "ab\xff", string(msg))
+}
+
+func Test_Conn_handleClose_invalidUTF8(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+
+	conn.isServer = false
+	require.Nil(t, conn.sendControlFrame(OpCodeClose, closePayload(CloseNormalClosure, "\xff")))
+	conn.isServer = true
+	_, _, err := conn.ReadMessage()
+	assert.Equal(t, ErrInvalidUTF8, err)
+	assert.Equal(t, Closed, conn.State())
+}
+
+func Test_Conn_SetWriteFragmentSize(t *testing.T) {
+	data := make([]byte, 65535*2)
+	rand.Read(data)
+
+	tests := []struct {
+		name  string
+		size  int
+		sizes []int
+	}{
+		{name: "default", size: 0, sizes: []int{65535, 65535}},
+		{name: "small", size: 50000, sizes: []int{50000, 50000, 31070}},
+		{name: "never", size: NoFragmentation, sizes: []int{65535 * 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			conn := mockConn(buf)
+			conn.SetWriteFragmentSize(tt.size)
+
+			// mock client send by WriteMessage and NextWriter
+			conn.isServer = false
+			require.Nil(t, conn.WriteMessage(BinaryMessage, data))
+			w, err := conn.NextWriter(BinaryMessage)
+			require.Nil(t, err)
+			_, err = w.Write(data[:1000])
+			require.Nil(t, err)
+			_, err = w.Write(data[1000:])
+			require.Nil(t, err)
+			require.Nil(t, w.Close())
+
+			conn.isServer = true
+			for i := 0; i < 2; i++ {
+				got := make([]byte, 0, len(data))
+				for j, size := range tt.sizes {
+					frm, err := conn.readFrame()
+					require.Nil(t, err)
+					assert.Equal(t, j == len(tt.sizes)-1, frm.isFinal())
+					assert.Equal(t, size, len(frm.Payload))
+					got = append(got, frm.Payload...)
+				}
+				assert.Equal(t, data, got)
+			}
+		})
+	}
+}
+
+// failReader yields data, then fails with err.
+type failReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func Test_Conn_SendBinary_readError(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	conn := mockConn(buf)
+	conn.isServer = false
+	errRead := errors.New("read failed")
+
+	// nothing has been sent, the message is dropped
+	err := conn.SendBinary(&failReader{data: make([]byte, 100), err: errRead})
+	assert.Equal(t, errRead, err)
+	assert.Equal(t, 0, buf.Len())
+	assert.Equal(t, Connected, conn.State())
+
+	// the first frame has been sent, the Conn is failed rather than finishing
+	// the message with truncated payload.
+	err = conn.SendBinary(&failReader{data: make([]byte, 65535+10), err: errRead})
+	assert.Equal(t, errRead, err)
+	assert.Equal(t, Closed, conn.State())
+
+	conn.isServer = true
+	frm, err := conn.readFrame()
+	require.Nil(t, err)
+	assert.Equal(t, uint16(0), frm.Fin)
+	assert.Equal(t, 65535, len(frm.Payload))
+	_, err = conn.readFrame()
+	assert.True(t, IsCloseError(err, CloseInternalServerErr), err)
+	assert.Equal(t, 0, buf.Len())
+}
@@ -38,6 +38,67 @@ const (
 	CloseTLSHandshake            = 1015
 )
 
+const (
+	// maxCloseReasonLen is the max length of close reason, since payload of
+	// control frame is at most 125 bytes, and 2 bytes are taken by code.
+	maxCloseReasonLen = 123
+)
+
+var (
+	// ErrInvalidCloseCode means the code could not be sent in close frame.
+	ErrInvalidCloseCode = errors.New("websocket: invalid close code")
+	// ErrCloseReasonTooLong means close reason is over 123 bytes.
+	ErrCloseReasonTooLong = errors.New("websocket: close reason is too long")
+)
+
+// IsCloseError reports whether err is *CloseError with any of codes.
+func IsCloseError(err error, codes ...int) bool {
+	if closeErr, ok := err.(*CloseError); ok {
+		for _, code := range codes {
+			if closeErr.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsUnexpectedCloseError reports whether err is *CloseError with none of
+// expectedCodes, e.g. it's unexpected if peer is not going away normally:
+//
+//		IsUnexpectedCloseError(err, CloseNormalClosure, CloseGoingAway)
+//
+func IsUnexpectedCloseError(err error, expectedCodes ...int) bool {
+	if _, ok := err.(*CloseError); !ok {
+		return false
+	}
+	return !IsCloseError(err, expectedCodes...)
+}
+
+// isValidCloseCode reports whether code could be sent in close frame,
+// RFC6455 Section-7.4.
+func isValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// closePayload builds payload of close frame, there is no payload if code
+// is CloseNoStatusReceived.
+func closePayload(code int, reason string) []byte {
+	if code == CloseNoStatusReceived {
+		return nil
+	}
+
+	p := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	return append(p, reason...)
+}
+
 // CloseError .
 type CloseError struct {
 	Code int
@@ -70,6 +131,10 @@ func (e *CloseError) Error() string {
 		s = append(s, " (mandatory extension missing)"...)
 	case CloseInternalServerErr:
 		s = append(s, " (internal server error)"...)
+	case CloseServiceRestart:
+		s = append(s, " (service restart)"...)
+	case CloseTryAgainLater:
+		s = append(s, " (try again later)"...)
 	case CloseTLSHandshake:
 		s = append(s, " (TLS handshake error)"...)
 	}
@@ -85,18 +150,47 @@ var (
 	ErrUnexpectedEOF = &CloseError{Code: CloseAbnormalClosure, Text: io.ErrUnexpectedEOF.Error()}
 	// ErrInvalidFrame .
 	ErrInvalidFrame = &CloseError{Code: CloseProtocolError, Text: "invalid frame: "}
+
+	// errors of frame from peer which violates RFC6455, the Conn is closed
+	// with CloseProtocolError once any of them is got.
+
+	// ErrReservedOpCode means opcode is one of reserved %x3-7 and %xB-F.
+	ErrReservedOpCode = newInvalidFrameError("reserved opcode")
+	// ErrFragmentedControlFrame means FIN of control frame is 0.
+	ErrFragmentedControlFrame = newInvalidFrameError("control frame is fragmented")
+	// ErrControlFrameTooBig means payload of control frame is over 125 bytes.
+	ErrControlFrameTooBig = newInvalidFrameError("control frame payload over 125 bytes")
+	// ErrNonMinimalLength means payload length is not encoded in the minimal
+	// number of bytes, or the most significant bit of 64-bit length is set.
+	ErrNonMinimalLength = newInvalidFrameError("payload length is not minimally encoded")
+	// ErrUnexpectedContinuation means continuation frame comes without a
+	// started message.
+	ErrUnexpectedContinuation = newInvalidFrameError("continuation frame without started message")
+	// ErrContinuationExpected means a new data frame comes while a fragmented
+	// message has not been finished.
+	ErrContinuationExpected = newInvalidFrameError("continuation frame expected")
+
+	// ErrInvalidClosePayload means close frame has 1 byte payload, or the
+	// close code could not be sent on the wire, RFC6455 Section-7.4.
+	ErrInvalidClosePayload = newInvalidFrameError("invalid close code or payload")
+
+	// ErrInvalidUTF8 means text message or close reason from peer is not valid
+	// UTF-8, the Conn is closed with CloseInvalidFramePayloadData.
+	ErrInvalidUTF8 = &CloseError{Code: CloseInvalidFramePayloadData, Text: "invalid UTF-8"}
 )
 
 // OpCode (4bit) it decides how to parse payload data.
 type OpCode uint16
 
+// OpCodes defined in RFC6455, they are exported so that frames could be
+// inspected or synthesized by FrameReader, FrameWriter and Conn.ReadFrame.
 const (
-	opCodeContinuation OpCode = 0  // 0x0 denotes a continuation frame .
-	opCodeText         OpCode = 1  // 0x1 denotes a text frame
-	opCodeBinary       OpCode = 2  // 0x2 denotes a binary frame
-	opCodeClose        OpCode = 8  // 0x8 denotes a connection close
-	opCodePing         OpCode = 9  // 0x9 denotes a ping
-	opCodePong         OpCode = 10 // 0xA denotes a pong
+	OpCodeContinuation OpCode = 0  // 0x0 denotes a continuation frame .
+	OpCodeText         OpCode = 1  // 0x1 denotes a text frame
+	OpCodeBinary       OpCode = 2  // 0x2 denotes a binary frame
+	OpCodeClose        OpCode = 8  // 0x8 denotes a connection close
+	OpCodePing         OpCode = 9  // 0x9 denotes a ping
+	OpCodePong         OpCode = 10 // 0xA denotes a pong
 	// opCodeReserved            = 3 - 7   // *  %x3-7 are reserved for further non-control frames
 	// opCode                    = 11 - 16 // *  %xB-F are reserved for further control frames
 )
@@ -236,13 +330,7 @@ func genMasks(maskingKey uint32) [4]byte {
 // transformed-octet-i = original-octet-i XOR masking-key-octet-j
 //
 func (frm *Frame) maskPayload() {
-	// masked := make([]byte, len(frm.Payload))
-	masks := genMasks(frm.MaskingKey)
-	for i, v := range frm.Payload {
-		j := i % 4
-		frm.Payload[i] = v ^ masks[j] // ^ means XOR
-	}
-	// frm.Payload = masked
+	maskBytes(genMasks(frm.MaskingKey), 0, frm.Payload)
 }
 
 // // unmaskPayload .
@@ -256,8 +344,8 @@ func (frm *Frame) maskPayload() {
 
 //// to mark current frame is used as control or data
 //func (frm *Frame) isControl() bool {
-//	return frm.OpCode == opCodePing || frm.OpCode == opCodePong ||
-//		frm.OpCode == opCodeClose || frm.OpCode == opCodeContinuation
+//	return frm.OpCode == OpCodePing || frm.OpCode == OpCodePong ||
+//		frm.OpCode == OpCodeClose || frm.OpCode == OpCodeContinuation
 //}
 
 // isFinal .
@@ -265,16 +353,47 @@ func (frm *Frame) isFinal() bool {
 	return frm.Fin == 1
 }
 
-func (frm *Frame) valid() error {
-	var err = ErrInvalidFrame
-	if frm.RSV1 != 0 || frm.RSV2 != 0 || frm.RSV3 != 0 {
-		err.Text += "reserved bit is not 0"
-		return err
+// newInvalidFrameError creates a new error based on ErrInvalidFrame, so that
+// ErrInvalidFrame would not be modified.
+func newInvalidFrameError(reason string) *CloseError {
+	return &CloseError{Code: ErrInvalidFrame.Code, Text: ErrInvalidFrame.Text + reason}
+}
+
+// valid check frame in common rules, rsv is the reserved bits (rsv1Mask,
+// rsv2Mask, rsv3Mask) which are owned by negotiated extensions.
+func (frm *Frame) valid(rsv uint16) error {
+	if (frm.RSV1 != 0 && rsv&rsv1Mask == 0) ||
+		(frm.RSV2 != 0 && rsv&rsv2Mask == 0) ||
+		(frm.RSV3 != 0 && rsv&rsv3Mask == 0) {
+		return newInvalidFrameError("reserved bit is not 0")
 	}
 
 	if frm.Mask == 1 && frm.MaskingKey == 0 {
-		err.Text += "masking key not set"
-		return err
+		return newInvalidFrameError("masking key not set")
+	}
+
+	switch frm.OpCode {
+	case OpCodeContinuation, OpCodeText, OpCodeBinary:
+	case OpCodeClose, OpCodePing, OpCodePong:
+		if frm.Fin != 1 {
+			return ErrFragmentedControlFrame
+		}
+		if frm.PayloadLen > 125 {
+			return ErrControlFrameTooBig
+		}
+	default:
+		return ErrReservedOpCode
+	}
+
+	switch frm.PayloadLen {
+	case 126:
+		if frm.PayloadExtendLen < 126 {
+			return ErrNonMinimalLength
+		}
+	case 127:
+		if frm.PayloadExtendLen <= 0xFFFF || frm.PayloadExtendLen>>63 != 0 {
+			return ErrNonMinimalLength
+		}
 	}
 
 	// return ErrInvalidFrame
@@ -282,22 +401,27 @@ func (frm *Frame) valid() error {
 }
 
 func calcBufLen(frm *Frame) (bufLen int) {
-	bufLen = 2
+	return frameHeaderLen(frm) + len(frm.Payload)
+}
+
+// frameHeaderLen returns the length of frame header, including the extended
+// payload length and masking key, PayloadLen and Mask of frm must be set.
+func frameHeaderLen(frm *Frame) (headerLen int) {
+	headerLen = 2
 
 	// FIXED: fill payloadExtendLen into 8 byte
 	switch frm.PayloadLen {
 	case 126:
-		bufLen += 2
+		headerLen += 2
 	case 127:
-		bufLen += 8
+		headerLen += 8
 	}
 
 	// FIXED: if not mask, then no set masking key
 	if frm.Mask == 1 {
-		bufLen += 4
+		headerLen += 4
 	}
 
-	bufLen += len(frm.Payload)
 	return
 }
 
@@ -374,20 +498,44 @@ func parseFrameHeader(header []byte) *Frame {
 	return frm
 }
 
-// fragmentDataFrames if data is too large so that could not be send in one frame.
-// TODO: opcode should opCodeContinuation and opCodeText
-func fragmentDataFrames(data []byte, noMask bool, opcode OpCode) []*Frame {
+// parseFrameHeaderExt parses the extended payload length and masking key of
+// frm from the whole header, and returns the length of payload.
+func parseFrameHeaderExt(frm *Frame, header []byte) (payloadLen uint64) {
+	offset := 2
+	switch frm.PayloadLen {
+	case 126:
+		frm.PayloadExtendLen = uint64(binary.BigEndian.Uint16(header[offset:]))
+		payloadLen = frm.PayloadExtendLen
+		offset += 2
+	case 127:
+		frm.PayloadExtendLen = binary.BigEndian.Uint64(header[offset:])
+		payloadLen = frm.PayloadExtendLen
+		offset += 8
+	default:
+		payloadLen = uint64(frm.PayloadLen)
+	}
+
+	if frm.Mask == 1 {
+		frm.MaskingKey = binary.BigEndian.Uint32(header[offset:])
+	}
+	return payloadLen
+}
+
+// fragmentDataFrames if data is too large so that could not be send in one frame,
+// payload of each frame is at most size bytes.
+// TODO: opcode should OpCodeContinuation and OpCodeText
+func fragmentDataFrames(data []byte, size int, noMask bool, opcode OpCode) []*Frame {
 	s := len(data)
-	start, end, n := 0, 0, s/65535
+	start, end, n := 0, 0, s/size
 
 	frames := make([]*Frame, 0, n+1)
 	for i := 1; i <= n; i++ {
-		start, end = (i-1)*65535, i*65535
-		frames = append(frames, constructDataFrame(data[start:end], noMask, opCodeContinuation))
+		start, end = (i-1)*size, i*size
+		frames = append(frames, constructDataFrame(data[start:end], noMask, OpCodeContinuation))
 	}
 
 	if end < s {
-		frames = append(frames, constructDataFrame(data[end:], noMask, opCodeContinuation))
+		frames = append(frames, constructDataFrame(data[end:], noMask, OpCodeContinuation))
 	}
 
 	frames[0].OpCode = opcode
@@ -398,10 +546,10 @@ func fragmentDataFrames(data []byte, noMask bool, opcode OpCode) []*Frame {
 }
 
 // constructDataFrame payload length is less than 65535
-// FIXED: default opCodeText, need support binary
+// FIXED: default OpCodeText, need support binary
 func constructDataFrame(payload []byte, noMask bool, opcode OpCode) *Frame {
-	// if opcode is opCodeContinuation, means this frame is not the final frame
-	final := opcode != opCodeContinuation
+	// if opcode is OpCodeContinuation, means this frame is not the final frame
+	final := opcode != OpCodeContinuation
 	frm := constructFrame(opcode, final, noMask)
 	// logger.Debugf("init: %+v", frm)
 	frm.setPayload(payload)
@@ -14,6 +14,7 @@ package websocket
 
 import (
 	"encoding/binary"
+	"io"
 	"strings"
 	"testing"
 
@@ -60,7 +61,7 @@ func mockFragmentFrames(noMask bool) []*Frame {
 		// RSV1:             0,
 		// RSV2:             0,
 		// RSV3:             0,
-		OpCode: opCodeText,
+		OpCode: OpCodeText,
 		Mask:   mask,
 		// PayloadLen:       0,
 		// PayloadExtendLen: 0,
@@ -73,7 +74,7 @@ func mockFragmentFrames(noMask bool) []*Frame {
 		// RSV1:             0,
 		// RSV2:             0,
 		// RSV3:             0,
-		OpCode: opCodeContinuation,
+		OpCode: OpCodeContinuation,
 		Mask:   mask,
 		// PayloadLen:       0,
 		// PayloadExtendLen: 0,
@@ -86,7 +87,7 @@ func mockFragmentFrames(noMask bool) []*Frame {
 		// RSV1:   0,
 		// RSV2:   0,
 		// RSV3:   0,
-		OpCode: opCodeContinuation,
+		OpCode: OpCodeContinuation,
 		Mask:   mask,
 		// PayloadLen:       0,
 		// PayloadExtendLen: 0,
@@ -181,7 +182,7 @@ func Test_constructFrame(t *testing.T) {
 		{
 			name: "case 0",
 			args: args{
-				opcode: opCodeText,
+				opcode: OpCodeText,
 				finnal: true,
 				noMask: true,
 			},
@@ -190,7 +191,7 @@ func Test_constructFrame(t *testing.T) {
 				RSV1:             0,
 				RSV2:             0,
 				RSV3:             0,
-				OpCode:           opCodeText,
+				OpCode:           OpCodeText,
 				Mask:             0,
 				PayloadLen:       0,
 				PayloadExtendLen: 0,
@@ -226,14 +227,14 @@ func Test_constructDataFrame(t *testing.T) {
 			args: args{
 				data:   []byte("hello"),
 				noMask: false,
-				opcode: opCodeText,
+				opcode: OpCodeText,
 			},
 			want: &Frame{
 				Fin:              1,
 				RSV1:             0,
 				RSV2:             0,
 				RSV3:             0,
-				OpCode:           opCodeText,
+				OpCode:           OpCodeText,
 				Mask:             1,
 				PayloadLen:       uint16(len([]byte("hello"))),
 				PayloadExtendLen: 0,
@@ -246,14 +247,14 @@ func Test_constructDataFrame(t *testing.T) {
 			args: args{
 				data:   []byte("hello"),
 				noMask: false,
-				opcode: opCodeBinary,
+				opcode: OpCodeBinary,
 			},
 			want: &Frame{
 				Fin:              1,
 				RSV1:             0,
 				RSV2:             0,
 				RSV3:             0,
-				OpCode:           opCodeBinary,
+				OpCode:           OpCodeBinary,
 				Mask:             1,
 				PayloadLen:       uint16(len([]byte("hello"))),
 				PayloadExtendLen: 0,
@@ -289,7 +290,7 @@ func Test_constructControlFrame(t *testing.T) {
 		{
 			name: "case 0",
 			args: args{
-				opcode:  opCodePing,
+				opcode:  OpCodePing,
 				noMask:  true,
 				payload: []byte("payload"),
 			},
@@ -298,7 +299,7 @@ func Test_constructControlFrame(t *testing.T) {
 				RSV1:             0,
 				RSV2:             0,
 				RSV3:             0,
-				OpCode:           opCodePing,
+				OpCode:           OpCodePing,
 				Mask:             0,
 				PayloadLen:       7,
 				PayloadExtendLen: 0,
@@ -328,6 +329,23 @@ func Test_FrameMaskAndUnmask(t *testing.T) {
 	assert.Equal(t, got, want)
 }
 
+func Test_maskBytes(t *testing.T) {
+	frm := mockFrame([]byte(strings.Repeat("hello", 10)))
+	masked := make([]byte, len(frm.Payload))
+	copy(masked, frm.Payload)
+	frm.maskPayload()
+
+	// unmask part by part
+	masks := genMasks(frm.MaskingKey)
+	pos, p := 0, masked
+	for _, n := range []int{1, 2, 3, 7, 37} {
+		pos = maskBytes(masks, pos, p[:n])
+		p = p[n:]
+	}
+	assert.Equal(t, 0, len(p))
+	assert.Equal(t, frm.Payload, masked)
+}
+
 func Test_Mask(t *testing.T) {
 	var maskingKey uint32 = 0x9acb0442
 	masks := genMasks(maskingKey)
@@ -391,6 +409,46 @@ func Test_Frame_valid(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name:    "case 2: reserved non-control opcode",
+			fields:  fields{Fin: 1, OpCode: 3},
+			wantErr: true,
+		},
+		{
+			name:    "case 3: reserved control opcode",
+			fields:  fields{Fin: 1, OpCode: 0xB},
+			wantErr: true,
+		},
+		{
+			name:    "case 4: fragmented control frame",
+			fields:  fields{Fin: 0, OpCode: OpCodePing},
+			wantErr: true,
+		},
+		{
+			name:    "case 5: control frame over 125 bytes",
+			fields:  fields{Fin: 1, OpCode: OpCodeClose, PayloadLen: 126, PayloadExtendLen: 200},
+			wantErr: true,
+		},
+		{
+			name:    "case 6: 16-bit length",
+			fields:  fields{Fin: 1, OpCode: OpCodeText, PayloadLen: 126, PayloadExtendLen: 200},
+			wantErr: false,
+		},
+		{
+			name:    "case 7: 16-bit length is not minimal",
+			fields:  fields{Fin: 1, OpCode: OpCodeText, PayloadLen: 126, PayloadExtendLen: 125},
+			wantErr: true,
+		},
+		{
+			name:    "case 8: 64-bit length is not minimal",
+			fields:  fields{Fin: 1, OpCode: OpCodeBinary, PayloadLen: 127, PayloadExtendLen: 65535},
+			wantErr: true,
+		},
+		{
+			name:    "case 9: 64-bit length with the most significant bit",
+			fields:  fields{Fin: 1, OpCode: OpCodeBinary, PayloadLen: 127, PayloadExtendLen: 1 << 63},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -406,7 +464,7 @@ func Test_Frame_valid(t *testing.T) {
 				MaskingKey:       tt.fields.MaskingKey,
 				Payload:          tt.fields.Payload,
 			}
-			if err := frm.valid(); (err != nil) != tt.wantErr {
+			if err := frm.valid(0); (err != nil) != tt.wantErr {
 				t.Errorf("Frame.valid() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -474,20 +532,20 @@ func Test_fragmentDataFrames(t *testing.T) {
 	data = append(data, part2...)
 	data = append(data, part3...)
 
-	frames := fragmentDataFrames(data, true, opCodeText)
+	frames := fragmentDataFrames(data, 65535, true, OpCodeText)
 
 	assert.Equal(t, 3, len(frames))
 
 	assert.Equal(t, uint16(0), frames[0].Fin)
-	assert.Equal(t, opCodeText, frames[0].OpCode)
+	assert.Equal(t, OpCodeText, frames[0].OpCode)
 	assert.Equal(t, []byte(part1), frames[0].Payload)
 
 	assert.Equal(t, uint16(0), frames[1].Fin)
-	assert.Equal(t, opCodeContinuation, frames[1].OpCode)
+	assert.Equal(t, OpCodeContinuation, frames[1].OpCode)
 	assert.Equal(t, []byte(part2), frames[1].Payload)
 
 	assert.Equal(t, uint16(1), frames[2].Fin)
-	assert.Equal(t, opCodeContinuation, frames[2].OpCode)
+	assert.Equal(t, OpCodeContinuation, frames[2].OpCode)
 	assert.Equal(t, []byte(part3), frames[2].Payload)
 }
 
@@ -499,21 +557,21 @@ func Test_fragmentDataFrames_times(t *testing.T) {
 	data = append(data, part1...)
 	data = append(data, part2...)
 
-	frames := fragmentDataFrames(data, true, opCodeText)
+	frames := fragmentDataFrames(data, 65535, true, OpCodeText)
 
 	assert.Equal(t, 2, len(frames))
 
 	assert.Equal(t, uint16(0), frames[0].Fin)
-	assert.Equal(t, opCodeText, frames[0].OpCode)
+	assert.Equal(t, OpCodeText, frames[0].OpCode)
 	assert.Equal(t, []byte(part1), frames[0].Payload)
 
 	assert.Equal(t, uint16(1), frames[1].Fin)
-	assert.Equal(t, opCodeContinuation, frames[1].OpCode)
+	assert.Equal(t, OpCodeContinuation, frames[1].OpCode)
 	assert.Equal(t, []byte(part2), frames[1].Payload)
 }
 
 func Benchmark_encodeFrameTo(b *testing.B) {
-	frame := constructFrame(opCodePing, true, true)
+	frame := constructFrame(OpCodePing, true, true)
 
 	for i := 0; i < b.N; i++ {
 		//byts := encodeFrameTo(frame)
@@ -549,3 +607,28 @@ func Benchmark_Frame_SetPayload_more65535(b *testing.B) {
 		_ = frm
 	}
 }
+
+func Test_CloseError_Error(t *testing.T) {
+	assert.Equal(t, "websocket: close 1012 (service restart)", (&CloseError{Code: CloseServiceRestart}).Error())
+	assert.Equal(t, "websocket: close 1013 (try again later): busy", (&CloseError{Code: CloseTryAgainLater, Text: "busy"}).Error())
+}
+
+func Test_IsCloseError(t *testing.T) {
+	err := &CloseError{Code: CloseGoingAway}
+	assert.True(t, IsCloseError(err, CloseNormalClosure, CloseGoingAway))
+	assert.False(t, IsCloseError(err, CloseNormalClosure))
+	assert.False(t, IsCloseError(io.EOF, CloseGoingAway))
+
+	assert.False(t, IsUnexpectedCloseError(err, CloseNormalClosure, CloseGoingAway))
+	assert.True(t, IsUnexpectedCloseError(err, CloseNormalClosure))
+	assert.False(t, IsUnexpectedCloseError(io.EOF, CloseNormalClosure))
+}
+
+func Test_isValidCloseCode(t *testing.T) {
+	for _, code := range []int{1000, 1001, 1003, 1007, 1011, 1012, 1013, 3000, 4999} {
+		assert.True(t, isValidCloseCode(code), code)
+	}
+	for _, code := range []int{0, 999, 1004, 1005, 1006, 1015, 1016, 2999, 5000} {
+		assert.False(t, isValidCloseCode(code), code)
+	}
+}
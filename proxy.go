@@ -0,0 +1,130 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+var (
+	// ErrUnsupportedProxy means the scheme of proxy URL is not supported,
+	// http, socks5 and socks5h are supported.
+	ErrUnsupportedProxy = errors.New("websocket: unsupported proxy scheme")
+	// ErrProxyRefused means the HTTP proxy refused the CONNECT request.
+	ErrProxyRefused = errors.New("websocket: proxy refused CONNECT request")
+)
+
+// netDialerFunc dials network connection, it implements proxy.Dialer and
+// proxy.ContextDialer, so that it could be forwarded by SOCKS5 proxy.
+type netDialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (fn netDialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return fn(context.Background(), network, addr)
+}
+
+func (fn netDialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return fn(ctx, network, addr)
+}
+
+// proxyDialer returns the dialer connecting through proxyURL, forward dials
+// the proxy server.
+func proxyDialer(proxyURL *url.URL, forward netDialerFunc) (netDialerFunc, error) {
+	switch proxyURL.Scheme {
+	case "http":
+		return (&httpProxyDialer{proxyURL: proxyURL, forward: forward}).DialContext, nil
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			auth = &proxy.Auth{User: proxyURL.User.Username()}
+			auth.Password, _ = proxyURL.User.Password()
+		}
+		d, err := proxy.SOCKS5("tcp", proxyAddr(proxyURL, "1080"), auth, forward)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedProxy, proxyURL.Scheme)
+}
+
+// proxyAddr returns host:port of proxyURL, port is defaultPort if it's not set.
+func proxyAddr(proxyURL *url.URL, defaultPort string) string {
+	port := proxyURL.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// httpProxyDialer makes a tunnel by CONNECT request to HTTP proxy, the
+// userinfo of proxyURL is sent as Proxy-Authorization.
+type httpProxyDialer struct {
+	proxyURL *url.URL
+	forward  netDialerFunc
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward(ctx, network, proxyAddr(d.proxyURL, "80"))
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := d.proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+
+	stop := watchDial(ctx, conn)
+	err = d.connect(conn, req)
+	if interrupted := stop(); interrupted && err != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// connect sends CONNECT request and reads the response.
+func (d *httpProxyDialer) connect(conn net.Conn, req *http.Request) error {
+	if err := req.Write(conn); err != nil {
+		debugErrorf("httpProxyDialer.connect failed to write request, err=%v", err)
+		return err
+	}
+
+	// the tunnel is established once response is received, nothing else
+	// would be sent by proxy, so that the reader could be dropped.
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		debugErrorf("httpProxyDialer.connect failed to read response, err=%v", err)
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", ErrProxyRefused, resp.Status)
+	}
+	if br.Buffered() != 0 {
+		return fmt.Errorf("%w: unexpected data after response", ErrProxyRefused)
+	}
+
+	return nil
+}
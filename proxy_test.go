@@ -0,0 +1,242 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tunnel copies data between conn and target until one of them is closed.
+func tunnel(conn, target net.Conn) {
+	go func() {
+		_, _ = io.Copy(target, conn)
+		_ = target.Close()
+	}()
+	_, _ = io.Copy(conn, target)
+	_ = conn.Close()
+}
+
+// newTestProxy starts a proxy stand-in, serve handles each connection. It
+// returns the address of proxy and the count of handled connections.
+func newTestProxy(t *testing.T, serve func(conn net.Conn)) (string, *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	var count int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&count, 1)
+			go serve(conn)
+		}
+	}()
+
+	return ln.Addr().String(), &count
+}
+
+// serveHTTPConnect is an HTTP proxy stand-in which only supports CONNECT.
+func serveHTTPConnect(auth string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+			_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			_ = conn.Close()
+			return
+		}
+
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			_ = conn.Close()
+			return
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		tunnel(conn, target)
+	}
+}
+
+// serveSOCKS5 is a SOCKS5 proxy stand-in which supports CONNECT with
+// username/password authentication only.
+func serveSOCKS5(user, password string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		target, err := socks5Handshake(conn, user, password)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		tunnel(conn, target)
+	}
+}
+
+func socks5Handshake(conn net.Conn, user, password string) (net.Conn, error) {
+	// greeting: VER NMETHODS METHODS, username/password is required
+	p := make([]byte, 2)
+	if _, err := io.ReadFull(conn, p); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, p[1])); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{0x05, 0x02}); err != nil {
+		return nil, err
+	}
+
+	// RFC1929: VER ULEN UNAME PLEN PASSWD
+	readString := func() (string, error) {
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return "", err
+		}
+		s := make([]byte, n[0])
+		_, err := io.ReadFull(conn, s)
+		return string(s), err
+	}
+	if _, err := io.ReadFull(conn, p[:1]); err != nil {
+		return nil, err
+	}
+	gotUser, err := readString()
+	if err != nil {
+		return nil, err
+	}
+	gotPassword, err := readString()
+	if err != nil {
+		return nil, err
+	}
+	if gotUser != user || gotPassword != password {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return nil, errors.New("authentication failed")
+	}
+	if _, err = conn.Write([]byte{0x01, 0x00}); err != nil {
+		return nil, err
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	var host string
+	switch header[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		if host, err = readString(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported address type")
+	}
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		_, _ = conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return nil, err
+	}
+	if _, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		_ = target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+// dialEcho dials wsURL through proxy, then sends and receives a message.
+func dialEcho(t *testing.T, wsURL string, proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	require.Nil(t, err)
+	conn, err := Dial(wsURL, WithProxy(http.ProxyURL(u)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	require.Nil(t, conn.SendMessage("through proxy"))
+	_, msg, err := conn.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "through proxy", string(msg))
+	return nil
+}
+
+func Test_Dial_HTTPProxy(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{})
+	defer srv.Close()
+
+	// "Basic " + base64("foo:bar")
+	addr, count := newTestProxy(t, serveHTTPConnect("Basic Zm9vOmJhcg=="))
+	require.Nil(t, dialEcho(t, wsURL, "http://foo:bar@"+addr))
+	assert.Equal(t, int32(1), atomic.LoadInt32(count))
+
+	err := dialEcho(t, wsURL, "http://foo:wrong@"+addr)
+	assert.True(t, errors.Is(err, ErrProxyRefused))
+}
+
+func Test_Dial_SOCKS5Proxy(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{})
+	defer srv.Close()
+
+	addr, count := newTestProxy(t, serveSOCKS5("foo", "bar"))
+	require.Nil(t, dialEcho(t, wsURL, "socks5://foo:bar@"+addr))
+	assert.Equal(t, int32(1), atomic.LoadInt32(count))
+
+	assert.Error(t, dialEcho(t, wsURL, "socks5://foo:wrong@"+addr))
+}
+
+func Test_Dial_Proxy(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{})
+	defer srv.Close()
+
+	// proxy gets the upgrade request, and nil means connecting directly
+	var got *http.Request
+	_, err := Dial(wsURL, WithProxy(func(req *http.Request) (*url.URL, error) {
+		got = req
+		return nil, nil
+	}))
+	require.Nil(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, "http", got.URL.Scheme)
+
+	err = dialEcho(t, wsURL, "ftp://127.0.0.1:21")
+	assert.True(t, errors.Is(err, ErrUnsupportedProxy))
+
+	// proxy is dialed by NetDialContext
+	addr, _ := newTestProxy(t, serveHTTPConnect(""))
+	var dialed string
+	d := Dialer{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "proxy.invalid:3128"}),
+		NetDialContext: func(ctx context.Context, network, a string) (net.Conn, error) {
+			dialed = a
+			return net.Dial(network, addr)
+		},
+	}
+	conn, _, err := d.DialContext(context.Background(), wsURL, nil)
+	require.Nil(t, err)
+	conn.Close()
+	assert.Equal(t, "proxy.invalid:3128", dialed)
+}
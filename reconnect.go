@@ -0,0 +1,379 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrDisconnected is returned by ReconnectingConn.WriteMessage while it's
+	// reconnecting with SendReject policy.
+	ErrDisconnected = errors.New("websocket: disconnected, reconnecting")
+	// ErrSendQueueFull is returned by ReconnectingConn.WriteMessage while it's
+	// reconnecting and ReconnectOptions.MaxQueue messages have been queued.
+	ErrSendQueueFull = errors.New("websocket: send queue is full")
+	// ErrReconnectStopped is returned by ReconnectingConn after Close.
+	ErrReconnectStopped = errors.New("websocket: reconnecting conn closed")
+)
+
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+	// DefaultReconnectJitter is the fraction of backoff delay randomized by
+	// default, see ReconnectOptions.Jitter.
+	DefaultReconnectJitter = 0.2
+)
+
+// SendPolicy decides how ReconnectingConn.WriteMessage works while it's
+// reconnecting.
+type SendPolicy int
+
+const (
+	// SendReject rejects messages with ErrDisconnected while reconnecting.
+	SendReject SendPolicy = iota
+	// SendQueue queues messages while reconnecting, they are sent in order
+	// once connected, after OnConnect returns.
+	SendQueue
+)
+
+// ReconnectOptions configures ReconnectingConn.
+type ReconnectOptions struct {
+	// Dialer dials the server, a Dialer with 10 seconds HandshakeTimeout is
+	// used if it's nil. Header and DialOptions are passed to DialContext.
+	Dialer      *Dialer
+	Header      http.Header
+	DialOptions []DialOption
+
+	// MinBackoff and MaxBackoff bound the delay before redialing, the delay
+	// doubles after each failed dialing or lost connection. They are 500ms
+	// and 30s by default.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// StableDuration is how long a connection must stay up before the delay
+	// is reset to MinBackoff, so that a server which accepts and drops at
+	// once is not redialed every MinBackoff. It's MaxBackoff by default.
+	StableDuration time.Duration
+	// Jitter is the fraction in [0, 1] of delay which is randomized, so that
+	// clients would not redial at the same time. 0 means
+	// DefaultReconnectJitter, and negative disables jitter.
+	Jitter float64
+	// MaxRetries is the max times of continuous failed dialing, then
+	// ReconnectingConn stops with the last error. 0 means no limit.
+	MaxRetries int
+
+	// SendPolicy of WriteMessage while reconnecting, SendReject by default.
+	SendPolicy SendPolicy
+	// MaxQueue is the max number of queued messages for SendQueue, 0 means
+	// no limit.
+	MaxQueue int
+
+	// OnConnect is called once connected before queued messages are sent,
+	// it's the place to resubscribe by writing into conn.
+	OnConnect func(conn *Conn)
+	// OnDisconnect is called once the connection is lost, err is the error
+	// of reading.
+	OnDisconnect func(err error)
+	// ShouldReconnect reports whether to redial after the connection is lost
+	// with err. By default, it stops only if server closes with
+	// CloseNormalClosure or ClosePolicyViolation.
+	ShouldReconnect func(err error) bool
+}
+
+// ReconnectingConn is a client connection which redials with exponential
+// backoff once the connection is lost, the backoff is reset only after a
+// connection stays up for StableDuration. Server's CloseTryAgainLater is
+// redialed after MaxBackoff.
+//
+// Messages are read by ReadMessage across connections, and the connection
+// is only monitored while reading, so ReadMessage MUST be called as Conn.
+type ReconnectingConn struct {
+	url  string
+	opts ReconnectOptions
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closed is set by Close before cancel, so that it's never blocked by mu.
+	closed int32
+
+	mu sync.Mutex
+	// conn is nil while reconnecting
+	conn  *Conn
+	queue []reconnectMessage
+	// err is the reason of stopping, it's set before done is closed.
+	err error
+
+	messages chan reconnectMessage
+	done     chan struct{}
+}
+
+type reconnectMessage struct {
+	mt   MessageType
+	data []byte
+}
+
+// NewReconnectingConn starts connecting to URL in background, and keeps
+// redialing until ctx is done, Close is called or it stops by options.
+func NewReconnectingConn(ctx context.Context, URL string, opts ReconnectOptions) *ReconnectingConn {
+	if opts.Dialer == nil {
+		opts.Dialer = &Dialer{HandshakeTimeout: defaultHandshakeTimeout}
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+	if opts.StableDuration <= 0 {
+		opts.StableDuration = opts.MaxBackoff
+	}
+	if opts.Jitter == 0 {
+		opts.Jitter = DefaultReconnectJitter
+	}
+	if opts.ShouldReconnect == nil {
+		opts.ShouldReconnect = shouldReconnect
+	}
+
+	rc := &ReconnectingConn{
+		url:      URL,
+		opts:     opts,
+		messages: make(chan reconnectMessage),
+		done:     make(chan struct{}),
+	}
+	rc.ctx, rc.cancel = context.WithCancel(ctx)
+	go rc.run()
+
+	return rc
+}
+
+// shouldReconnect is the default ReconnectOptions.ShouldReconnect.
+func shouldReconnect(err error) bool {
+	return !IsCloseError(err, CloseNormalClosure, ClosePolicyViolation)
+}
+
+// ReadMessage reads next message from current connection, it waits while
+// reconnecting. The error is returned only if ReconnectingConn has stopped,
+// it's ErrReconnectStopped after Close, ctx.Err() if ctx is done, or the
+// error which stops reconnecting.
+func (rc *ReconnectingConn) ReadMessage() (MessageType, []byte, error) {
+	select {
+	case msg := <-rc.messages:
+		return msg.mt, msg.data, nil
+	case <-rc.done:
+		return NoFrame, nil, rc.err
+	}
+}
+
+// WriteMessage writes message into current connection. While reconnecting,
+// it works as ReconnectOptions.SendPolicy.
+func (rc *ReconnectingConn) WriteMessage(mt MessageType, data []byte) error {
+	rc.mu.Lock()
+	conn := rc.conn
+	if conn == nil {
+		defer rc.mu.Unlock()
+		switch {
+		case rc.err != nil:
+			return rc.err
+		case rc.opts.SendPolicy != SendQueue:
+			return ErrDisconnected
+		case rc.opts.MaxQueue > 0 && len(rc.queue) >= rc.opts.MaxQueue:
+			return ErrSendQueueFull
+		}
+		rc.queue = append(rc.queue, reconnectMessage{mt: mt, data: append([]byte(nil), data...)})
+		return nil
+	}
+	rc.mu.Unlock()
+
+	return conn.WriteMessage(mt, data)
+}
+
+// Conn returns current connection, it's nil while reconnecting.
+func (rc *ReconnectingConn) Conn() *Conn {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.conn
+}
+
+// Close stops reconnecting and closes current connection normally.
+func (rc *ReconnectingConn) Close() {
+	atomic.StoreInt32(&rc.closed, 1)
+	rc.cancel()
+	<-rc.done
+}
+
+func (rc *ReconnectingConn) run() {
+	var (
+		err error
+		// retries is the times of continuous failed dialing, and attempt is
+		// the times of redialing since the last stable connection.
+		retries int
+		attempt int
+	)
+	defer func() { rc.stop(err) }()
+
+	for {
+		var conn *Conn
+		conn, _, err = rc.opts.Dialer.DialContext(rc.ctx, rc.url, rc.opts.Header, rc.opts.DialOptions...)
+		if err != nil {
+			debugErrorf("ReconnectingConn.run failed to dial, err=%v", err)
+			retries++
+			attempt++
+			if rc.ctx.Err() != nil || (rc.opts.MaxRetries > 0 && retries >= rc.opts.MaxRetries) {
+				return
+			}
+			if err = rc.sleep(rc.backoff(attempt)); err != nil {
+				return
+			}
+			continue
+		}
+
+		retries = 0
+		start := time.Now()
+		err = rc.serve(conn)
+		if rc.ctx.Err() != nil || !rc.opts.ShouldReconnect(err) {
+			return
+		}
+
+		// the connection lost soon keeps growing the backoff
+		if time.Since(start) >= rc.opts.StableDuration {
+			attempt = 0
+		}
+		attempt++
+		delay := rc.backoff(attempt)
+		if IsCloseError(err, CloseTryAgainLater) {
+			delay = rc.jitter(rc.opts.MaxBackoff)
+		}
+		if err = rc.sleep(delay); err != nil {
+			return
+		}
+	}
+}
+
+// serve makes conn current connection and reads messages from it until
+// it's lost, then returns the error of reading.
+func (rc *ReconnectingConn) serve(conn *Conn) (err error) {
+	// close conn once ReconnectingConn is stopped
+	connDone := make(chan struct{})
+	defer close(connDone)
+	go func() {
+		select {
+		case <-rc.ctx.Done():
+			conn.Close()
+		case <-connDone:
+		}
+	}()
+
+	if rc.opts.OnConnect != nil {
+		rc.opts.OnConnect(conn)
+	}
+	if err = rc.flush(conn); err != nil {
+		debugErrorf("ReconnectingConn.serve failed to send queued messages, err=%v", err)
+	}
+
+	for err == nil {
+		var msg reconnectMessage
+		if msg.mt, msg.data, err = conn.ReadMessage(); err != nil {
+			break
+		}
+		select {
+		case rc.messages <- msg:
+		case <-rc.ctx.Done():
+			err = rc.ctx.Err()
+		}
+	}
+
+	rc.mu.Lock()
+	rc.conn = nil
+	rc.mu.Unlock()
+	if conn.State() != Closed {
+		conn.Close()
+	}
+	if rc.opts.OnDisconnect != nil {
+		rc.opts.OnDisconnect(err)
+	}
+	return err
+}
+
+// flush sends queued messages in order, then makes conn current connection.
+// Messages are sent without holding mu, so that WriteMessage and Close are not
+// blocked by a slow peer. The messages which are not sent are kept in queue.
+func (rc *ReconnectingConn) flush(conn *Conn) error {
+	for {
+		rc.mu.Lock()
+		queue := rc.queue
+		rc.queue = nil
+		if len(queue) == 0 {
+			// messages queued while flushing have been sent
+			rc.conn = conn
+			rc.mu.Unlock()
+			return nil
+		}
+		rc.mu.Unlock()
+
+		for i, msg := range queue {
+			if err := conn.WriteMessage(msg.mt, msg.data); err != nil {
+				rc.mu.Lock()
+				rc.queue = append(queue[i:], rc.queue...)
+				rc.mu.Unlock()
+				return err
+			}
+		}
+	}
+}
+
+// stop records the reason of stopping, and wakes up readers and writers.
+func (rc *ReconnectingConn) stop(err error) {
+	rc.mu.Lock()
+	switch {
+	case atomic.LoadInt32(&rc.closed) == 1:
+		err = ErrReconnectStopped
+	case rc.ctx.Err() != nil:
+		err = rc.ctx.Err()
+	}
+	rc.err = err
+	rc.mu.Unlock()
+
+	rc.cancel()
+	close(rc.done)
+}
+
+// backoff returns the delay before the attempt-th redialing, attempt starts
+// from 1.
+func (rc *ReconnectingConn) backoff(attempt int) time.Duration {
+	delay := rc.opts.MinBackoff
+	for i := 1; i < attempt && delay < rc.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > rc.opts.MaxBackoff {
+		delay = rc.opts.MaxBackoff
+	}
+	return rc.jitter(delay)
+}
+
+// jitter reduces delay by a random fraction of it, at most opts.Jitter.
+func (rc *ReconnectingConn) jitter(delay time.Duration) time.Duration {
+	if rc.opts.Jitter <= 0 {
+		return delay
+	}
+	return delay - time.Duration(rand.Float64()*rc.opts.Jitter*float64(delay))
+}
+
+// sleep waits for delay, it returns ctx.Err() if ctx is done.
+func (rc *ReconnectingConn) sleep(delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-rc.ctx.Done():
+		return rc.ctx.Err()
+	}
+}
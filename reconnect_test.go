@@ -0,0 +1,320 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ReconnectingConn_backoff(t *testing.T) {
+	rc := &ReconnectingConn{opts: ReconnectOptions{
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: time.Second,
+		Jitter:     -1,
+	}}
+	assert.Equal(t, 100*time.Millisecond, rc.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, rc.backoff(2))
+	assert.Equal(t, 800*time.Millisecond, rc.backoff(4))
+	assert.Equal(t, time.Second, rc.backoff(5))
+	assert.Equal(t, time.Second, rc.backoff(100))
+
+	rc.opts.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := rc.backoff(1)
+		assert.True(t, delay > 50*time.Millisecond && delay <= 100*time.Millisecond, delay)
+	}
+}
+
+func Test_ReconnectingConn_reconnect(t *testing.T) {
+	// the first connection is closed with CloseServiceRestart, the second
+	// connection echoes.
+	var count int32
+	srv, wsURL := newTestServer(Upgrader{}, func(conn *Conn) {
+		n := atomic.AddInt32(&count, 1)
+		_ = conn.SendMessage(fmt.Sprintf("hello-%d", n))
+		if n == 1 {
+			_ = conn.CloseWithCode(CloseServiceRestart, "restart")
+			return
+		}
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			_ = conn.SendMessage(string(msg))
+		}
+	})
+	defer srv.Close()
+
+	var connects, disconnects int32
+	disconnected := make(chan error, 2)
+	rc := NewReconnectingConn(context.Background(), wsURL, ReconnectOptions{
+		MinBackoff: 10 * time.Millisecond,
+		OnConnect: func(conn *Conn) {
+			atomic.AddInt32(&connects, 1)
+			_ = conn.SendMessage("subscribe")
+		},
+		OnDisconnect: func(err error) {
+			atomic.AddInt32(&disconnects, 1)
+			disconnected <- err
+		},
+	})
+
+	_, msg, err := rc.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "hello-1", string(msg))
+	assert.True(t, IsCloseError(<-disconnected, CloseServiceRestart))
+
+	_, msg, err = rc.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "hello-2", string(msg))
+	// resubscribed by OnConnect
+	_, msg, err = rc.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "subscribe", string(msg))
+
+	require.Nil(t, rc.WriteMessage(TextMessage, []byte("after reconnect")))
+	_, msg, err = rc.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "after reconnect", string(msg))
+	assert.NotNil(t, rc.Conn())
+
+	rc.Close()
+	_, _, err = rc.ReadMessage()
+	assert.Equal(t, ErrReconnectStopped, err)
+	assert.Equal(t, ErrReconnectStopped, rc.WriteMessage(TextMessage, []byte("closed")))
+	assert.Nil(t, rc.Conn())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&connects))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&disconnects))
+}
+
+// newFlakyServer returns an echo server which refuses the first n upgrade
+// requests with 503.
+func newFlakyServer(n int32) (*httptest.Server, string) {
+	var count int32
+	ug := Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&count, 1) <= n {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = ug.Upgrade(w, req, func(conn *Conn) {
+			for {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				_ = conn.SendMessage(string(msg))
+			}
+		})
+	}))
+
+	return srv, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func Test_ReconnectingConn_SendPolicy(t *testing.T) {
+	srv, wsURL := newFlakyServer(3)
+	defer srv.Close()
+
+	rc := NewReconnectingConn(context.Background(), wsURL, ReconnectOptions{
+		MinBackoff: 50 * time.Millisecond,
+		SendPolicy: SendQueue,
+		MaxQueue:   2,
+	})
+	defer rc.Close()
+
+	// queued while dialing
+	require.Nil(t, rc.WriteMessage(TextMessage, []byte("1")))
+	require.Nil(t, rc.WriteMessage(TextMessage, []byte("2")))
+	assert.Equal(t, ErrSendQueueFull, rc.WriteMessage(TextMessage, []byte("3")))
+
+	for _, want := range []string{"1", "2"} {
+		_, msg, err := rc.ReadMessage()
+		require.Nil(t, err)
+		assert.Equal(t, want, string(msg))
+	}
+
+	srv2, wsURL2 := newFlakyServer(100)
+	defer srv2.Close()
+	rc2 := NewReconnectingConn(context.Background(), wsURL2, ReconnectOptions{
+		MinBackoff: 10 * time.Millisecond,
+	})
+	defer rc2.Close()
+	assert.Equal(t, ErrDisconnected, rc2.WriteMessage(TextMessage, []byte("rejected")))
+}
+
+func Test_ReconnectingConn_stop(t *testing.T) {
+	srv, wsURL := newFlakyServer(100)
+	defer srv.Close()
+
+	// MaxRetries
+	rc := NewReconnectingConn(context.Background(), wsURL, ReconnectOptions{
+		MinBackoff: 10 * time.Millisecond,
+		MaxRetries: 3,
+	})
+	_, _, err := rc.ReadMessage()
+	var herr HandshakeError
+	require.True(t, errors.As(err, &herr), err)
+	assert.Equal(t, http.StatusServiceUnavailable, herr.StatusCode)
+
+	// context cancellation while backing off
+	ctx, cancel := context.WithCancel(context.Background())
+	rc = NewReconnectingConn(ctx, wsURL, ReconnectOptions{MinBackoff: time.Hour})
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, _, err = rc.ReadMessage()
+	assert.Equal(t, context.Canceled, err)
+
+	// context cancellation while connected
+	srv2, wsURL2 := newEchoServer(Upgrader{})
+	defer srv2.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	connected := make(chan struct{})
+	rc = NewReconnectingConn(ctx, wsURL2, ReconnectOptions{
+		OnConnect: func(conn *Conn) { close(connected) },
+	})
+	<-connected
+	cancel()
+	_, _, err = rc.ReadMessage()
+	assert.Equal(t, context.Canceled, err)
+
+	// server closes normally
+	srv3, wsURL3 := newTestServer(Upgrader{}, func(conn *Conn) {
+		_ = conn.CloseWithCode(CloseNormalClosure, "bye")
+	})
+	defer srv3.Close()
+	rc = NewReconnectingConn(context.Background(), wsURL3, ReconnectOptions{MinBackoff: 10 * time.Millisecond})
+	_, _, err = rc.ReadMessage()
+	assert.True(t, IsCloseError(err, CloseNormalClosure), err)
+}
+
+func Test_ReconnectingConn_TryAgainLater(t *testing.T) {
+	var count int32
+	connected := make(chan time.Time, 2)
+	srv, wsURL := newTestServer(Upgrader{}, func(conn *Conn) {
+		connected <- time.Now()
+		if atomic.AddInt32(&count, 1) == 1 {
+			_ = conn.CloseWithCode(CloseTryAgainLater, "busy")
+			return
+		}
+		_ = conn.SendMessage("welcome back")
+		_, _, _ = conn.ReadMessage()
+	})
+	defer srv.Close()
+
+	rc := NewReconnectingConn(context.Background(), wsURL, ReconnectOptions{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 200 * time.Millisecond,
+		Jitter:     -1,
+	})
+	defer rc.Close()
+
+	_, msg, err := rc.ReadMessage()
+	require.Nil(t, err)
+	assert.Equal(t, "welcome back", string(msg))
+	first, second := <-connected, <-connected
+	assert.GreaterOrEqual(t, int64(second.Sub(first)), int64(200*time.Millisecond))
+}
+
+func Test_ReconnectingConn_unstable(t *testing.T) {
+	// server accepts and drops at once, the backoff keeps growing
+	connected := make(chan time.Time, 10)
+	srv, wsURL := newTestServer(Upgrader{}, func(conn *Conn) {
+		connected <- time.Now()
+		_ = conn.CloseWithCode(CloseServiceRestart, "restart")
+	})
+	defer srv.Close()
+
+	rc := NewReconnectingConn(context.Background(), wsURL, ReconnectOptions{
+		MinBackoff:     10 * time.Millisecond,
+		MaxBackoff:     80 * time.Millisecond,
+		StableDuration: time.Second,
+		Jitter:         -1,
+	})
+	defer rc.Close()
+
+	last := <-connected
+	for _, want := range []time.Duration{10, 20, 40, 80, 80} {
+		next := <-connected
+		assert.GreaterOrEqual(t, int64(next.Sub(last)), int64(want*time.Millisecond))
+		last = next
+	}
+}
+
+// stallConn blocks writing once stall is closed, until it's closed.
+type stallConn struct {
+	net.Conn
+	stall  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.stall:
+		<-c.closed
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *stallConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func Test_ReconnectingConn_Close_flushing(t *testing.T) {
+	srv, wsURL := newEchoServer(Upgrader{})
+	defer srv.Close()
+
+	// writing blocks once connected, so that flushing queued messages blocks
+	stall := make(chan struct{})
+	dialer := &Dialer{NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &stallConn{Conn: conn, stall: stall, closed: make(chan struct{})}, nil
+	}}
+	flushing := make(chan struct{})
+	rc := NewReconnectingConn(context.Background(), wsURL, ReconnectOptions{
+		Dialer:     dialer,
+		SendPolicy: SendQueue,
+		OnConnect: func(conn *Conn) {
+			conn.SetCloseTimeout(100 * time.Millisecond)
+			close(stall)
+			close(flushing)
+		},
+	})
+	require.Nil(t, rc.WriteMessage(TextMessage, []byte("queued")))
+	<-flushing
+	time.Sleep(50 * time.Millisecond)
+
+	// neither WriteMessage nor Close is blocked by flushing
+	closed := make(chan error, 1)
+	go func() {
+		err := rc.WriteMessage(TextMessage, []byte("queued while flushing"))
+		rc.Close()
+		closed <- err
+	}()
+	select {
+	case err := <-closed:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocked by flushing")
+	}
+	_, _, err := rc.ReadMessage()
+	assert.Equal(t, ErrReconnectStopped, err)
+}
@@ -23,12 +23,22 @@ import (
 	"time"
 )
 
-// HandshakeError .
+// HandshakeError means the opening handshake failed. On client side, the
+// response from server is carried, Body is at most maxHandshakeBodySize bytes.
 type HandshakeError struct {
 	Text string
+
+	// StatusCode, Header and Body of the response, they are set only on
+	// client side.
+	StatusCode int
+	Header     http.Header
+	Body       []byte
 }
 
 func (e HandshakeError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("HandshakeError(Text=%s, StatusCode=%d)", e.Text, e.StatusCode)
+	}
 	return fmt.Sprintf("HandshakeError(Text=%s)", e.Text)
 }
 
@@ -41,6 +51,59 @@ type Upgrader struct {
 	CheckOrigin func(req *http.Request) bool
 
 	Timeout time.Duration
+
+	// EnableCompression specifies whether the server should try to negotiate
+	// permessage-deflate extension (RFC7692) with client.
+	EnableCompression bool
+
+	// CompressionOptions configures the permessage-deflate extension, it
+	// works only if EnableCompression is true.
+	CompressionOptions CompressionOptions
+
+	// Extensions which server supports, the negotiation follows the order of
+	// client's offers. permessage-deflate is appended if EnableCompression.
+	Extensions []Extension
+
+	// Subprotocols which server supports, server chooses the first one of
+	// client's Sec-WebSocket-Protocol which is in Subprotocols.
+	Subprotocols []string
+
+	// SelectSubprotocol overrides the default choosing of Subprotocols if it's
+	// not nil, offered is the client's preference. Returning "" means none.
+	SelectSubprotocol func(req *http.Request, offered []string) string
+
+	// Keepalive sends ping while Conn is idle, and closes Conn if client
+	// does not respond in time. It's disabled if Keepalive.Interval is 0.
+	Keepalive KeepaliveOptions
+
+	// MaxMessageSize is the read limit of Conn, see Conn.SetReadLimit.
+	// 0 means no limit.
+	MaxMessageSize int64
+
+	// MaxFrameSize is the max size of frame payload from client, the Conn is
+	// closed with CloseMessageTooBig if it's exceeded. 0 means no limit.
+	MaxFrameSize int64
+
+	// ReadBufferSize and WriteBufferSize are the size of I/O buffers of Conn,
+	// 0 means 64KB for reading and 4KB for writing. The buffers returned by
+	// http.Hijacker are reused if they are large enough.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// WriteBufferPool lends write buffers to Conns only while frames are
+	// being written, so that idle Conns hold no write buffer. It should be
+	// shared by Upgraders with the same WriteBufferSize.
+	WriteBufferPool BufferPool
+
+	// WriteFragmentSize is the max payload size of each frame of messages
+	// sent by server, see Conn.SetWriteFragmentSize. 0 means
+	// DefaultWriteFragmentSize, and NoFragmentation means never fragment.
+	WriteFragmentSize int
+
+	// SkipUTF8Validation skips validating text messages and close reasons from
+	// client, it's for trusted clients. By default, the Conn is closed with
+	// CloseInvalidFramePayloadData once invalid UTF-8 comes.
+	SkipUTF8Validation bool
 }
 
 const defaultUpgraderTimeout = 10 * time.Second
@@ -108,8 +171,17 @@ func (ug Upgrader) Upgrade(w http.ResponseWriter, req *http.Request, fn func(con
 	respHeaders.Set("Upgrade", "websocket")
 	challengeKey := req.Header.Get("Sec-WebSocket-Key")
 	respHeaders.Set("Sec-WebSocket-Accept", computeAcceptKey(challengeKey))
-	// TODO: support Sec-WebSocket-Protocol header, get header from client request and judge the protocol is available.
-	// respHeaders.Set("Sec-WebSocket-Protocol", "http")
+
+	// negotiate extensions
+	exts, extHeader := acceptExtensions(ug.extensions(), parseExtensions(req.Header))
+	if extHeader != "" {
+		respHeaders.Set("Sec-WebSocket-Extensions", extHeader)
+	}
+	// DONE: support Sec-WebSocket-Protocol header, get header from client request and judge the protocol is available.
+	subprotocol := ug.selectSubprotocol(req)
+	if subprotocol != "" {
+		respHeaders.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
 
 	// finish response and send
 	// FIXED: http.Hijacker could not h.Hijack twice
@@ -120,8 +192,21 @@ func (ug Upgrader) Upgrade(w http.ResponseWriter, req *http.Request, fn func(con
 	}
 	logger.Debugf("Upgrader.Upgrade hackHandshakeResponse finished")
 
-	conn, _ := newConn(netconn, true)
-	conn.State = Connected
+	conn, _ := newConn(netconn, true, bufferOptions{
+		readBufferSize:  ug.ReadBufferSize,
+		writeBufferSize: ug.WriteBufferSize,
+		writePool:       ug.WriteBufferPool,
+		br:              brw.Reader,
+		bw:              brw.Writer,
+	})
+	conn.extensions = exts
+	conn.subprotocol = subprotocol
+	conn.readLimit = ug.MaxMessageSize
+	conn.maxFrameSize = ug.MaxFrameSize
+	conn.writeFragmentSize = ug.WriteFragmentSize
+	conn.skipUTF8Validation = ug.SkipUTF8Validation
+	conn.setState(Connected)
+	conn.startKeepalive(ug.Keepalive)
 	// start a goroutine to handle with websocket.Conn
 	go func() {
 		defer func() {
@@ -137,6 +222,32 @@ func (ug Upgrader) Upgrade(w http.ResponseWriter, req *http.Request, fn func(con
 	return nil
 }
 
+// extensions returns all extensions supported by server.
+func (ug Upgrader) extensions() []Extension {
+	exts := ug.Extensions
+	if ug.EnableCompression {
+		exts = append(exts[:len(exts):len(exts)], newPermessageDeflate(ug.CompressionOptions))
+	}
+	return exts
+}
+
+// selectSubprotocol chooses subprotocol from client's offers.
+func (ug Upgrader) selectSubprotocol(req *http.Request) string {
+	offered := parseSubprotocols(req.Header)
+	if ug.SelectSubprotocol != nil {
+		return ug.SelectSubprotocol(req, offered)
+	}
+
+	for _, p := range offered {
+		for _, supported := range ug.Subprotocols {
+			if p == supported {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
 // handshakeCheck . check request headers and set necessary headers to Response
 func (ug Upgrader) handshakeCheck(w http.ResponseWriter, req *http.Request) error {
 	h := req.Header.Get("Connection")
@@ -1,7 +1,12 @@
 package websocket
 
 import (
+	"bytes"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 
 	"github.com/yeqown/log"
 )
@@ -37,13 +42,53 @@ func echo(w http.ResponseWriter, req *http.Request) {
 	log.Infof("conn upgrade done")
 }
 
-func init() {
-	go func() {
-		// prepare and server on 8080
-		http.HandleFunc("/echo", echo)
+// newTestServer starts a server with ug, fn handles each Conn. It returns the
+// server and the WebSocket URL to dial.
+func newTestServer(ug Upgrader, fn func(conn *Conn)) (*httptest.Server, string) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = ug.Upgrade(w, req, fn)
+	}))
+
+	return srv, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// newEchoServer starts an echo server with ug, returns the server and
+// the WebSocket URL to dial.
+func newEchoServer(ug Upgrader) (*httptest.Server, string) {
+	return newTestServer(ug, func(conn *Conn) {
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if mt == BinaryMessage {
+				err = conn.SendBinary(bytes.NewReader(msg))
+			} else {
+				err = conn.SendMessage(string(msg))
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+var echoServerOnce sync.Once
 
-		if err := http.ListenAndServe(":8080", nil); err != nil {
+// startEchoServer prepares and serves on 8080 once, it's started by the tests
+// which dial it rather than init, so that fuzzing workers never listen on it.
+func startEchoServer() {
+	echoServerOnce.Do(func() {
+		http.HandleFunc("/echo", echo)
+		ln, err := net.Listen("tcp", ":8080")
+		if err != nil {
 			log.Fatal(err)
 		}
-	}()
+
+		go func() {
+			if err := http.Serve(ln, nil); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	})
 }
@@ -1,10 +1,15 @@
 package websocket
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
 	"io"
+	"net"
+	"net/http"
+	"strings"
+	"unicode/utf8"
 )
 
 var keyGUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
@@ -25,8 +30,106 @@ func computeAcceptKey(challengeKey string) string {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
+// headerContainsToken reports whether token is in comma separated values of
+// header[name], tokens are case-insensitive.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, h := range header[name] {
+		for _, t := range strings.Split(h, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseSubprotocols parse all Sec-WebSocket-Protocol headers into protocols
+// with the same order, RFC6455 Section-4.1
+func parseSubprotocols(header http.Header) []string {
+	var protocols []string
+	for _, h := range header["Sec-Websocket-Protocol"] {
+		for _, p := range strings.Split(h, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
+
 // // get high 16bit from uint64
 // func bigendian16BitFromUint64(v uint64) uint16 {
 // 	v = v >> (64 - 16)
 // 	return uint16(v)
 // }
+
+// acquire takes the semaphore, or fails with ctx.Err() once ctx is done.
+func acquire(ctx context.Context, sem chan struct{}) error {
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release gives back the semaphore taken by acquire.
+func release(sem chan struct{}) {
+	<-sem
+}
+
+// isTimeout reports whether err is a timeout of net.Error.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// utf8Validator validates UTF-8 incrementally, since a rune may be split
+// across frames or reads.
+type utf8Validator struct {
+	// pending is the incomplete rune at the end of last write
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+// write validates p, the incomplete rune at the end is kept for next write.
+// It reports false once invalid UTF-8 is found.
+func (v *utf8Validator) write(p []byte) bool {
+	// complete the pending rune first
+	for v.n != 0 && len(p) != 0 {
+		v.pending[v.n] = p[0]
+		v.n++
+		p = p[1:]
+		if !utf8.FullRune(v.pending[:v.n]) {
+			continue
+		}
+		if r, size := utf8.DecodeRune(v.pending[:v.n]); r == utf8.RuneError && size <= 1 {
+			return false
+		}
+		v.n = 0
+	}
+	if v.n != 0 {
+		// p is taken by the pending rune
+		return true
+	}
+
+	end := len(p)
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(p[:end]) {
+		return false
+	}
+	v.n = copy(v.pending[:], p[end:])
+	return true
+}
+
+// done reports whether there is no incomplete rune left.
+func (v *utf8Validator) done() bool {
+	return v.n == 0
+}
@@ -1,9 +1,52 @@
 package websocket
 
 import (
+	"net/http"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
+func Test_utf8Validator(t *testing.T) {
+	// valid UTF-8 in any chunks
+	text := []byte("hello, 世界 🌍 ok")
+	for i := 0; i <= len(text); i++ {
+		for j := i; j <= len(text); j++ {
+			v := new(utf8Validator)
+			assert.True(t, v.write(text[:i]))
+			assert.True(t, v.write(text[i:j]))
+			assert.True(t, v.write(text[j:]))
+			assert.True(t, v.done())
+		}
+	}
+
+	tests := []struct {
+		name  string
+		data  string
+		valid bool
+		done  bool
+	}{
+		{name: "invalid byte", data: "ab\xff", valid: false},
+		{name: "surrogate", data: "\xed\xa0\x80", valid: false},
+		{name: "overlong", data: "\xc0\xaf", valid: false},
+		{name: "incomplete rune", data: "ab\xe4\xb8", valid: true, done: false},
+		{name: "U+FFFD", data: "\xef\xbf\xbd", valid: true, done: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := new(utf8Validator)
+			valid := true
+			for i := 0; i < len(tt.data) && valid; i++ {
+				valid = v.write([]byte{tt.data[i]})
+			}
+			assert.Equal(t, tt.valid, valid)
+			if valid {
+				assert.Equal(t, tt.done, v.done())
+			}
+		})
+	}
+}
+
 func Test_generateChallengeKey(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -52,6 +95,15 @@ func Test_computeAcceptKey(t *testing.T) {
 	}
 }
 
+func Test_parseSubprotocols(t *testing.T) {
+	header := http.Header{}
+	header.Add("Sec-WebSocket-Protocol", "chat, superchat")
+	header.Add("Sec-WebSocket-Protocol", " mqtt ,")
+
+	assert.Equal(t, []string{"chat", "superchat", "mqtt"}, parseSubprotocols(header))
+	assert.Nil(t, parseSubprotocols(http.Header{}))
+}
+
 // func Test_bigendianUint64(t *testing.T) {
 // 	type args struct {
 // 		v uint64